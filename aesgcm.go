@@ -0,0 +1,395 @@
+package oasis_sdk
+
+// aesgcm.go implements encrypted file sharing as per https://xmpp.org/extensions/xep-0454.html
+// Files are encrypted with AES-256-GCM while they are streamed, so they are never held in memory.
+// The standard library only seals whole messages, so the GCM construction is done here on top of
+// AES, following https://nvlpubs.nist.gov/nistpubs/Legacy/SP/nistspecialpublication800-38d.pdf
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+
+	"mellium.im/xmpp/upload"
+)
+
+const (
+	// schemeAesgcm is the URL scheme of encrypted files
+	schemeAesgcm = "aesgcm"
+	gcmKeySize   = 32
+	gcmIVSize    = 12
+	// gcmLegacyIVSize is the IV size older clients use, still accepted when downloading
+	gcmLegacyIVSize = 16
+	gcmTagSize      = 16
+	gcmBlockSize    = 16
+)
+
+// ErrDecryptionFailed is returned by Download when an encrypted file was tampered with or the key is wrong.
+// Anything already written must be discarded.
+var ErrDecryptionFailed = errors.New("file could not be decrypted")
+
+// UploadEncrypted works like UploadWithResult, but encrypts the file with a new random AES-256-GCM key first.
+// The GET URL of the result is an aesgcm:// URL carrying the key, which must only be shared over an
+// end-to-end encrypted channel. The other fields describe the file before encryption.
+func (client *XmppClient) UploadEncrypted(ctx context.Context, name string, size int64, r io.Reader, opts UploadOptions) (*UploadResult, error) {
+	if name == "" || size <= 0 {
+		return nil, errors.New("name and content cannot be empty")
+	}
+
+	file, err := client.prepareUpload(ctx, name, size, r, opts, gcmTagSize)
+	if err != nil {
+		return nil, err
+	}
+	name, size, r = file.name, file.size, file.r
+	contentType := file.contentType
+
+	secret := make([]byte, gcmIVSize+gcmKeySize)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate key: %w", err)
+	}
+	iv, key := secret[:gcmIVSize], secret[gcmIVSize:]
+
+	//every attempt encrypts the file again, the same key and IV give the same bytes
+	rewind, ok := rewinder(r)
+	if !ok {
+		//streams that can't seek back are only sent once
+		opts.Retries = -1
+	}
+	var probe *mediaProbe
+	open := func() (io.Reader, error) {
+		if probe != nil {
+			probe.close(errUploadRetried)
+			err := rewind()
+			if err != nil {
+				return nil, err
+			}
+		}
+		probe = newMediaProbe(contentType, !opts.NoPreview)
+		return newGCMEncryptReader(io.TeeReader(io.LimitReader(r, size), probe), key, iv)
+	}
+
+	//the server only sees opaque bytes, so don't tell it what they are
+	request := upload.File{
+		Name: filepath.Base(name),
+		Size: int(size + gcmTagSize),
+		Type: "application/octet-stream",
+	}
+	getURL, err := client.uploadStream(ctx, request, open, opts)
+	if probe != nil {
+		probe.close(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(getURL)
+	if err != nil {
+		return nil, fmt.Errorf("server returned invalid GET URL: %w", err)
+	}
+	u.Scheme = schemeAesgcm
+	u.Fragment = hex.EncodeToString(secret)
+
+	res := &UploadResult{
+		GetURL:      u.String(),
+		Name:        request.Name,
+		Size:        size,
+		ContentType: contentType,
+	}
+	probe.fill(res)
+	return res, nil
+}
+
+// parseAesgcmURL splits an aesgcm:// URL into the https URL of the file and its IV and key
+func parseAesgcmURL(u *url.URL) (string, []byte, []byte, error) {
+	secret, err := hex.DecodeString(u.Fragment)
+	if err != nil {
+		return "", nil, nil, fmt.Errorf("invalid key in aesgcm URL: %w", err)
+	}
+	if len(secret) != gcmIVSize+gcmKeySize && len(secret) != gcmLegacyIVSize+gcmKeySize {
+		return "", nil, nil, errors.New("invalid key length in aesgcm URL")
+	}
+	ivSize := len(secret) - gcmKeySize
+
+	plain := *u
+	plain.Scheme = "https"
+	plain.Fragment = ""
+	plain.RawFragment = ""
+	return plain.String(), secret[:ivSize], secret[ivSize:], nil
+}
+
+// gcmStream is the state of AES-GCM over a stream: the counter mode keystream and the running GHASH of the ciphertext
+type gcmStream struct {
+	block     cipher.Block
+	counter   [gcmBlockSize]byte
+	keystream [gcmBlockSize]byte
+	used      int // bytes of keystream already used
+	ghash     ghash
+	partial   [gcmBlockSize]byte // ciphertext not yet hashed, GHASH works on whole blocks
+	npartial  int
+	length    uint64 // ciphertext length in bytes
+	tagMask   [gcmBlockSize]byte
+}
+
+func newGCMStream(key []byte, iv []byte) (*gcmStream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &gcmStream{
+		block: block,
+		used:  gcmBlockSize,
+	}
+	var h [gcmBlockSize]byte
+	block.Encrypt(h[:], h[:])
+	s.ghash = newGHash(h)
+
+	//the pre-counter block is the IV with a counter of one, or the GHASH of other IV sizes
+	var j0 [gcmBlockSize]byte
+	if len(iv) == gcmIVSize {
+		copy(j0[:], iv)
+		j0[gcmBlockSize-1] = 1
+	} else {
+		g := newGHash(h)
+		g.update(iv)
+		g.updateLengths(0, uint64(len(iv)))
+		j0 = g.sum()
+	}
+	block.Encrypt(s.tagMask[:], j0[:])
+	s.counter = j0
+	gcmInc32(&s.counter)
+	return s, nil
+}
+
+// xor applies the keystream to src, which encrypts and decrypts alike
+func (s *gcmStream) xor(dst []byte, src []byte) {
+	for i := range src {
+		if s.used == gcmBlockSize {
+			s.block.Encrypt(s.keystream[:], s.counter[:])
+			gcmInc32(&s.counter)
+			s.used = 0
+		}
+		dst[i] = src[i] ^ s.keystream[s.used]
+		s.used++
+	}
+}
+
+// hash adds ciphertext to the authentication tag
+func (s *gcmStream) hash(ciphertext []byte) {
+	s.length += uint64(len(ciphertext))
+	if s.npartial > 0 {
+		n := copy(s.partial[s.npartial:], ciphertext)
+		s.npartial += n
+		ciphertext = ciphertext[n:]
+		if s.npartial < gcmBlockSize {
+			return
+		}
+		s.ghash.update(s.partial[:])
+		s.npartial = 0
+	}
+	whole := len(ciphertext) - len(ciphertext)%gcmBlockSize
+	s.ghash.update(ciphertext[:whole])
+	s.npartial = copy(s.partial[:], ciphertext[whole:])
+}
+
+// tag returns the authentication tag of the ciphertext hashed so far
+func (s *gcmStream) tag() []byte {
+	g := s.ghash
+	if s.npartial > 0 {
+		//update pads the last block with zeros
+		g.update(s.partial[:s.npartial])
+	}
+	g.updateLengths(0, s.length)
+	sum := g.sum()
+	tag := make([]byte, gcmTagSize)
+	subtle.XORBytes(tag, sum[:], s.tagMask[:])
+	return tag
+}
+
+// gcmInc32 increments the last 32 bits of the counter block
+func gcmInc32(counter *[gcmBlockSize]byte) {
+	binary.BigEndian.PutUint32(counter[12:], binary.BigEndian.Uint32(counter[12:])+1)
+}
+
+// gcmEncryptReader encrypts the plaintext read from r, followed by the authentication tag
+type gcmEncryptReader struct {
+	r      io.Reader
+	stream *gcmStream
+	tag    []byte // set once the plaintext is exhausted
+}
+
+func newGCMEncryptReader(r io.Reader, key []byte, iv []byte) (*gcmEncryptReader, error) {
+	stream, err := newGCMStream(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmEncryptReader{r: r, stream: stream}, nil
+}
+
+// Read implements io.Reader
+func (e *gcmEncryptReader) Read(p []byte) (int, error) {
+	if e.tag != nil {
+		if len(e.tag) == 0 {
+			return 0, io.EOF
+		}
+		n := copy(p, e.tag)
+		e.tag = e.tag[n:]
+		return n, nil
+	}
+	n, err := e.r.Read(p)
+	e.stream.xor(p[:n], p[:n])
+	e.stream.hash(p[:n])
+	if err == io.EOF {
+		e.tag = e.stream.tag()
+		//hand out the tag on the next read
+		if n == 0 {
+			return e.Read(p)
+		}
+		return n, nil
+	}
+	return n, err
+}
+
+// gcmDecryptReader decrypts the ciphertext read from r. The last bytes are the tag, so they are
+// held back until r ends, and the end is only reported once the tag checks out.
+type gcmDecryptReader struct {
+	r       io.Reader
+	stream  *gcmStream
+	buf     []byte // ciphertext read but not yet released
+	scratch []byte
+	err     error // error of r, returned once buf is drained
+}
+
+func newGCMDecryptReader(r io.Reader, key []byte, iv []byte) (*gcmDecryptReader, error) {
+	stream, err := newGCMStream(key, iv)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmDecryptReader{r: r, stream: stream, scratch: make([]byte, 32*1024)}, nil
+}
+
+// Read implements io.Reader
+func (d *gcmDecryptReader) Read(p []byte) (int, error) {
+	for {
+		//everything but the last bytes, which may be the tag, can be released
+		if len(d.buf) > gcmTagSize && len(p) > 0 {
+			n := min(len(p), len(d.buf)-gcmTagSize)
+			d.stream.hash(d.buf[:n])
+			d.stream.xor(p[:n], d.buf[:n])
+			d.buf = d.buf[n:]
+			return n, nil
+		}
+		if d.err == io.EOF {
+			if len(d.buf) != gcmTagSize || subtle.ConstantTimeCompare(d.stream.tag(), d.buf) != 1 {
+				return 0, ErrDecryptionFailed
+			}
+			return 0, io.EOF
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		n, err := d.r.Read(d.scratch)
+		d.buf = append(d.buf, d.scratch[:n]...)
+		d.err = err
+	}
+}
+
+// ghashElement is an element of GF(2^128) as used by GHASH, high holds the first 8 bytes
+type ghashElement struct {
+	high, low uint64
+}
+
+// ghash computes GHASH with a 4 bit table of multiples of the hash key
+type ghash struct {
+	table [16]ghashElement
+	y     ghashElement
+}
+
+// ghashReduction is the reduction of the 4 bits shifted out of an element by a multiplication
+var ghashReduction = [16]uint64{
+	0x0000, 0x1c20, 0x3840, 0x2460, 0x7080, 0x6ca0, 0x48c0, 0x54e0,
+	0xe100, 0xfd20, 0xd940, 0xc560, 0x9180, 0x8da0, 0xa9c0, 0xb5e0,
+}
+
+func newGHash(h [gcmBlockSize]byte) ghash {
+	g := ghash{}
+	x := ghashElement{binary.BigEndian.Uint64(h[:8]), binary.BigEndian.Uint64(h[8:])}
+	//bits are reflected in GHASH, so the table is indexed by the reversed nibble
+	g.table[ghashReverse(1)] = x
+	for i := 2; i < 16; i += 2 {
+		g.table[ghashReverse(i)] = ghashDouble(g.table[ghashReverse(i/2)])
+		double := g.table[ghashReverse(i)]
+		g.table[ghashReverse(i+1)] = ghashElement{double.high ^ x.high, double.low ^ x.low}
+	}
+	return g
+}
+
+func ghashReverse(i int) int {
+	i = ((i << 2) & 0xc) | ((i >> 2) & 0x3)
+	i = ((i << 1) & 0xa) | ((i >> 1) & 0x5)
+	return i
+}
+
+// ghashDouble multiplies x by the generator
+func ghashDouble(x ghashElement) ghashElement {
+	double := ghashElement{
+		high: x.high >> 1,
+		low:  x.low>>1 | x.high<<63,
+	}
+	if x.low&1 == 1 {
+		double.high ^= 0xe100000000000000
+	}
+	return double
+}
+
+// mul multiplies y by the hash key
+func (g *ghash) mul() {
+	z := ghashElement{}
+	for _, word := range [2]uint64{g.y.low, g.y.high} {
+		for j := 0; j < 64; j += 4 {
+			shifted := z.low & 0xf
+			z.low = z.low>>4 | z.high<<60
+			z.high = z.high>>4 ^ ghashReduction[shifted]<<48
+			t := g.table[word&0xf]
+			z.high ^= t.high
+			z.low ^= t.low
+			word >>= 4
+		}
+	}
+	g.y = z
+}
+
+// update hashes data, padding a trailing partial block with zeros
+func (g *ghash) update(data []byte) {
+	for len(data) > 0 {
+		var block [gcmBlockSize]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		g.y.high ^= binary.BigEndian.Uint64(block[:8])
+		g.y.low ^= binary.BigEndian.Uint64(block[8:])
+		g.mul()
+	}
+}
+
+// updateLengths hashes the final block holding the bit lengths of the additional data and ciphertext
+func (g *ghash) updateLengths(additional uint64, ciphertext uint64) {
+	g.y.high ^= additional * 8
+	g.y.low ^= ciphertext * 8
+	g.mul()
+}
+
+func (g *ghash) sum() [gcmBlockSize]byte {
+	var out [gcmBlockSize]byte
+	binary.BigEndian.PutUint64(out[:8], g.y.high)
+	binary.BigEndian.PutUint64(out[8:], g.y.low)
+	return out
+}
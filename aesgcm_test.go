@@ -0,0 +1,123 @@
+package oasis_sdk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// gcmReaders wrap the input of the streaming readers, so reads of every size are covered
+var gcmReaders = map[string]func(io.Reader) io.Reader{
+	"whole":   func(r io.Reader) io.Reader { return r },
+	"onebyte": iotest.OneByteReader,
+	"half":    iotest.HalfReader,
+}
+
+var gcmLengths = []int{0, 1, 15, 16, 17, 4099}
+
+func gcmTestData(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7) + seed
+	}
+	return data
+}
+
+func gcmReference(t *testing.T, key []byte, iv []byte) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestGCMMatchesStandardLibrary(t *testing.T) {
+	key := gcmTestData(gcmKeySize, 1)
+	for _, ivSize := range []int{gcmIVSize, gcmLegacyIVSize} {
+		iv := gcmTestData(ivSize, 2)
+		aead := gcmReference(t, key, iv)
+		for _, n := range gcmLengths {
+			plaintext := gcmTestData(n, 3)
+			sealed := aead.Seal(nil, iv, plaintext, nil)
+			for name, wrap := range gcmReaders {
+				t.Run(fmt.Sprintf("iv%d/len%d/%s", ivSize, n, name), func(t *testing.T) {
+					enc, err := newGCMEncryptReader(wrap(bytes.NewReader(plaintext)), key, iv)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err := io.ReadAll(wrap(enc))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, sealed) {
+						t.Fatalf("encrypted %x, want %x", got, sealed)
+					}
+
+					dec, err := newGCMDecryptReader(wrap(bytes.NewReader(sealed)), key, iv)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err = io.ReadAll(wrap(dec))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(got, plaintext) {
+						t.Fatalf("decrypted %x, want %x", got, plaintext)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestGCMDetectsTampering(t *testing.T) {
+	key := gcmTestData(gcmKeySize, 4)
+	for _, ivSize := range []int{gcmIVSize, gcmLegacyIVSize} {
+		iv := gcmTestData(ivSize, 5)
+		aead := gcmReference(t, key, iv)
+		for _, n := range gcmLengths {
+			sealed := aead.Seal(nil, iv, gcmTestData(n, 6), nil)
+			//flip a bit in the first byte, the last ciphertext byte and the tag
+			for _, pos := range []int{0, max(0, n-1), len(sealed) - 1} {
+				tampered := bytes.Clone(sealed)
+				tampered[pos] ^= 0x01
+				for name, wrap := range gcmReaders {
+					dec, err := newGCMDecryptReader(wrap(bytes.NewReader(tampered)), key, iv)
+					if err != nil {
+						t.Fatal(err)
+					}
+					_, err = io.ReadAll(wrap(dec))
+					if !errors.Is(err, ErrDecryptionFailed) {
+						t.Errorf("iv%d/len%d/pos%d/%s: got %v, want ErrDecryptionFailed", ivSize, n, pos, name, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestGCMRejectsTruncatedFiles(t *testing.T) {
+	key := gcmTestData(gcmKeySize, 7)
+	iv := gcmTestData(gcmIVSize, 8)
+	sealed := gcmReference(t, key, iv).Seal(nil, iv, gcmTestData(100, 9), nil)
+	for _, n := range []int{0, gcmTagSize - 1, len(sealed) - 1} {
+		dec, err := newGCMDecryptReader(bytes.NewReader(sealed[:n]), key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.ReadAll(dec)
+		if err == nil {
+			t.Errorf("len%d: truncated file decrypted without error", n)
+		}
+	}
+}
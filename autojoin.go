@@ -0,0 +1,108 @@
+package oasis_sdk
+
+// autojoin.go joins bookmarked rooms after connecting, as per https://xmpp.org/extensions/xep-0402.html#autojoin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/bookmarks"
+)
+
+// Values of XmppClient.AutojoinLevel
+const (
+	// AutojoinNone joins no rooms on connect
+	AutojoinNone int32 = iota
+	// AutojoinBookmarked joins the bookmarks with autojoin set, the default
+	AutojoinBookmarked
+	// AutojoinAll joins every bookmarked room
+	AutojoinAll
+)
+
+const (
+	// how many rooms are joined at the same time
+	autojoinConcurrency = 5
+	// how long a single room may take to join
+	autojoinTimeout = time.Minute
+)
+
+// SetAutojoinErrorHandler sets the handler function called for every room autojoin failed to join.
+func (client *XmppClient) SetAutojoinErrorHandler(handler AutojoinErrorHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.AutojoinErrorHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// autojoinBookmarks fetches the bookmarks and joins the rooms AutojoinLevel asks for, a few at a time.
+// Rooms we are already in are skipped, so this is safe to run again after a reconnect.
+func (client *XmppClient) autojoinBookmarks() {
+	level := client.AutojoinLevel.Load()
+	if level == AutojoinNone {
+		return
+	}
+
+	client.fetchBookmarks(false)
+
+	var toJoin []bookmarks.Channel
+	client.bookmarkLock.RLock()
+	client.mucLock.RLock()
+	for _, bookmark := range client.bookmarks {
+		if level != AutojoinAll && !bookmark.Autojoin {
+			continue
+		}
+		if _, ok := client.MucChannels[bookmark.JID.Bare().String()]; ok {
+			continue
+		}
+		toJoin = append(toJoin, bookmark)
+	}
+	client.mucLock.RUnlock()
+	client.bookmarkLock.RUnlock()
+
+	//limit how many joins are in flight, large bookmark lists would flood the server otherwise
+	sem := make(chan struct{}, autojoinConcurrency)
+	wg := sync.WaitGroup{}
+	for _, bookmark := range toJoin {
+		select {
+		case <-client.Ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			client.autojoin(bookmark)
+		}()
+	}
+	wg.Wait()
+}
+
+// autojoin joins a single bookmarked room, reporting failure to the AutojoinErrorHandler
+func (client *XmppClient) autojoin(bookmark bookmarks.Channel) {
+	//bookmarks don't need a nick, fall back to our username
+	if bookmark.Nick == "" {
+		bookmark.Nick = client.JID.Localpart()
+	}
+
+	ctx, cancel := context.WithTimeout(client.Ctx, autojoinTimeout)
+	defer cancel()
+
+	_, err := client.ConnectMuc(bookmark, client.AutojoinHistory, ctx)
+	if err == nil {
+		return
+	}
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.AutojoinErrorHandler
+	client.handlers.Lock.Unlock()
+
+	if handler == nil {
+		fmt.Printf("Could not autojoin %s: %v\n", bookmark.JID.String(), err)
+		return
+	}
+	handler(client, bookmark, err)
+}
@@ -0,0 +1,476 @@
+package oasis_sdk
+
+// avatar.go implements User Avatars as per https://xmpp.org/extensions/xep-0084.html
+// with a fallback to vCard-based avatars as per https://xmpp.org/extensions/xep-0153.html
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	nsAvatarData     = "urn:xmpp:avatar:data"
+	nsAvatarMetadata = "urn:xmpp:avatar:metadata"
+)
+
+// avatarMaxSize is the largest width or height of an avatar we publish, in pixels
+const avatarMaxSize = 192
+
+// avatarCacheDir is the name of the avatar cache inside LoginInfo.CacheDir
+const avatarCacheDir = "avatars"
+
+// Avatar is a downloaded avatar image, identified by the SHA-1 hash of its data
+type Avatar struct {
+	Hash     string
+	MimeType string
+	Data     []byte
+}
+
+// AvatarInfo is the metadata of a published avatar
+type AvatarInfo struct {
+	XMLName xml.Name `xml:"info"`
+	ID      string   `xml:"id,attr"`
+	Bytes   int      `xml:"bytes,attr"`
+	Type    string   `xml:"type,attr"`
+	Width   int      `xml:"width,attr,omitempty"`
+	Height  int      `xml:"height,attr,omitempty"`
+	URL     string   `xml:"url,attr,omitempty"`
+}
+
+// AvatarMetadata is the payload of the metadata node, an empty list means the avatar was disabled
+type AvatarMetadata struct {
+	XMLName xml.Name     `xml:"urn:xmpp:avatar:metadata metadata"`
+	Info    []AvatarInfo `xml:"info"`
+}
+
+// AvatarData is the payload of the data node
+type AvatarData struct {
+	XMLName xml.Name `xml:"urn:xmpp:avatar:data data"`
+	Value   string   `xml:",chardata"`
+}
+
+// avatarState tracks the last known avatar hash of every entity, and our own
+type avatarState struct {
+	lock   sync.Mutex
+	hashes map[string]string
+	own    *string
+}
+
+// SetAvatarHandler sets the handler function called when a contact changes or removes their avatar.
+// The hash is empty when the avatar was removed, otherwise it can be passed to FetchAvatar.
+func (client *XmppClient) SetAvatarHandler(handler AvatarHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.AvatarHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// FetchAvatar returns the avatar of j with the given hash, from the disk cache if possible.
+// If hash is empty the current avatar is looked up first. The avatar is fetched from PEP,
+// falling back to vcard-temp for entities that don't publish one there.
+func (client *XmppClient) FetchAvatar(ctx context.Context, j jid.JID, hash string) (*Avatar, error) {
+	if hash != "" {
+		avatar, ok := client.cachedAvatar(hash)
+		if ok {
+			return avatar, nil
+		}
+	}
+
+	//occupants are only reachable through the room, which doesn't forward PEP queries
+	var avatar *Avatar
+	pepErr := errOccupantPEP
+	if !client.isOccupant(j) {
+		avatar, pepErr = client.fetchPEPAvatar(ctx, j, hash)
+	}
+	if pepErr != nil {
+		var vcardErr error
+		avatar, vcardErr = client.fetchVCardAvatar(ctx, j)
+		if vcardErr != nil {
+			return nil, fmt.Errorf("unable to fetch avatar of %s: %w", j.String(), errors.Join(pepErr, vcardErr))
+		}
+	}
+
+	//never hand out or cache data that doesn't match what was asked for
+	if hash != "" && avatar.Hash != hash {
+		return nil, fmt.Errorf("avatar of %s does not match hash %s", j.String(), hash)
+	}
+
+	client.cacheAvatar(avatar)
+	return avatar, nil
+}
+
+// fetchPEPAvatar fetches the metadata if needed, then the data of the avatar from the PEP nodes of j.
+func (client *XmppClient) fetchPEPAvatar(ctx context.Context, j jid.JID, hash string) (*Avatar, error) {
+	mimeType := ""
+	if hash == "" {
+		metadata := AvatarMetadata{}
+		err := client.fetchPEPItem(ctx, j, nsAvatarMetadata, "", &metadata)
+		if err != nil {
+			return nil, err
+		}
+		if len(metadata.Info) == 0 {
+			return nil, errors.New("avatar is disabled")
+		}
+		hash = metadata.Info[0].ID
+		mimeType = metadata.Info[0].Type
+	}
+
+	data := AvatarData{}
+	err := client.fetchPEPItem(ctx, j, nsAvatarData, hash, &data)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data.Value))
+	if err != nil {
+		return nil, fmt.Errorf("avatar data is not valid base64: %w", err)
+	}
+	if mimeType == "" {
+		mimeType = http.DetectContentType(raw)
+	}
+	return newAvatar(raw, mimeType), nil
+}
+
+// fetchVCardAvatar fetches the photo from the vcard-temp of j.
+func (client *XmppClient) fetchVCardAvatar(ctx context.Context, j jid.JID) (*Avatar, error) {
+	vcard, err := client.fetchVCardTemp(ctx, j)
+	if err != nil {
+		return nil, err
+	}
+	if vcard.Photo == nil || vcard.Photo.BinVal == "" {
+		return nil, errors.New("vcard has no photo")
+	}
+
+	//BINVAL is commonly line wrapped
+	binVal := strings.Join(strings.Fields(vcard.Photo.BinVal), "")
+	raw, err := base64.StdEncoding.DecodeString(binVal)
+	if err != nil {
+		return nil, fmt.Errorf("vcard photo is not valid base64: %w", err)
+	}
+	mimeType := vcard.Photo.Type
+	if mimeType == "" {
+		mimeType = http.DetectContentType(raw)
+	}
+	return newAvatar(raw, mimeType), nil
+}
+
+// errNoPEPItem is returned by fetchPEPItem when the node has no matching item
+var errNoPEPItem = errors.New("no item found")
+
+// errOccupantPEP is why the PEP nodes of room occupants aren't queried
+var errOccupantPEP = errors.New("PEP of room occupants is not reachable")
+
+// isOccupant reports whether j is the full JID of an occupant of a room we joined.
+// Queries for occupants go to that JID, the room forwards them to the occupant.
+func (client *XmppClient) isOccupant(j jid.JID) bool {
+	if j.Resourcepart() == "" {
+		return false
+	}
+	client.mucLock.RLock()
+	defer client.mucLock.RUnlock()
+	_, ok := client.MucChannels[j.Bare().String()]
+	return ok
+}
+
+// fetchPEPItem decodes a single item of a PEP node of j into v. An empty id fetches the latest item.
+func (client *XmppClient) fetchPEPItem(ctx context.Context, j jid.JID, node string, id string, v any) error {
+	iter := pubsub.FetchIQ(ctx, stanza.IQ{To: j.Bare()}, client.Session, pubsub.Query{
+		Node:     node,
+		Item:     id,
+		MaxItems: 1,
+	})
+	found := false
+	for iter.Next() {
+		_, r := iter.Item()
+		if found || r == nil {
+			continue
+		}
+		err := xml.NewTokenDecoder(r).Decode(v)
+		if err != nil {
+			/* #nosec */
+			iter.Close()
+			return err
+		}
+		found = true
+	}
+	err := iter.Err()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w on node %s", errNoPEPItem, node)
+	}
+	return nil
+}
+
+// newAvatar wraps raw image data, computing its hash
+func newAvatar(raw []byte, mimeType string) *Avatar {
+	sum := sha1.Sum(raw)
+	return &Avatar{
+		Hash:     hex.EncodeToString(sum[:]),
+		MimeType: mimeType,
+		Data:     raw,
+	}
+}
+
+// avatarPath returns where an avatar is cached on disk, or "" when there is no cache dir.
+func (client *XmppClient) avatarPath(hash string) string {
+	if client.Login.CacheDir == "" {
+		return ""
+	}
+	//hashes come from the network, never let them escape the cache dir
+	_, err := hex.DecodeString(hash)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(client.Login.CacheDir, avatarCacheDir, hash)
+}
+
+// cachedAvatar reads an avatar from the disk cache
+func (client *XmppClient) cachedAvatar(hash string) (*Avatar, bool) {
+	path := client.avatarPath(hash)
+	if path == "" {
+		return nil, false
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	avatar := newAvatar(raw, http.DetectContentType(raw))
+	if avatar.Hash != hash {
+		return nil, false
+	}
+	return avatar, true
+}
+
+// cacheAvatar writes an avatar to the disk cache
+func (client *XmppClient) cacheAvatar(avatar *Avatar) {
+	path := client.avatarPath(avatar.Hash)
+	if path == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		fmt.Printf("Could not create avatar cache dir: %v\n", err)
+		return
+	}
+	err = os.WriteFile(path, avatar.Data, 0o600)
+	if err != nil {
+		fmt.Printf("Could not write avatar cache: %v\n", err)
+	}
+}
+
+// PublishAvatarBytes decodes an image and publishes it as our avatar. See PublishAvatar.
+func (client *XmppClient) PublishAvatarBytes(ctx context.Context, data []byte) (string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("unable to decode avatar image: %w", err)
+	}
+	return client.PublishAvatar(ctx, img)
+}
+
+// PublishAvatar scales img down to fit 192x192, then publishes it as a PNG to our PEP avatar nodes
+// and our vcard-temp, and announces the new hash in our presence.
+// Returns the SHA-1 hash of the published avatar.
+func (client *XmppClient) PublishAvatar(ctx context.Context, img image.Image) (string, error) {
+	img = scaleDown(img, avatarMaxSize)
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode avatar: %w", err)
+	}
+	avatar := newAvatar(buf.Bytes(), "image/png")
+	encoded := base64.StdEncoding.EncodeToString(avatar.Data)
+
+	//data has to be published before metadata, so it's there when contacts are notified
+	item, err := marshalTokens(AvatarData{Value: encoded})
+	if err != nil {
+		return "", err
+	}
+	_, err = pubsub.Publish(ctx, client.Session, nsAvatarData, avatar.Hash, item)
+	if err != nil {
+		return "", fmt.Errorf("unable to publish avatar data: %w", err)
+	}
+
+	bounds := img.Bounds()
+	item, err = marshalTokens(AvatarMetadata{Info: []AvatarInfo{{
+		ID:     avatar.Hash,
+		Bytes:  len(avatar.Data),
+		Type:   avatar.MimeType,
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+	}}})
+	if err != nil {
+		return "", err
+	}
+	_, err = pubsub.Publish(ctx, client.Session, nsAvatarMetadata, avatar.Hash, item)
+	if err != nil {
+		return "", fmt.Errorf("unable to publish avatar metadata: %w", err)
+	}
+
+	//keep the vcard in sync for clients that only support XEP-0153
+	vcard, err := client.fetchVCardTemp(ctx, jid.JID{})
+	if err != nil {
+		//an account without a vcard answers item-not-found
+		vcard = &vCardTemp{}
+	}
+	vcard.Photo = &vCardTempPhoto{
+		Type:   avatar.MimeType,
+		BinVal: encoded,
+	}
+	err = client.publishVCardTemp(ctx, vcard)
+	if err != nil {
+		return "", fmt.Errorf("unable to publish vcard avatar: %w", err)
+	}
+
+	client.cacheAvatar(avatar)
+
+	client.avatars.lock.Lock()
+	client.avatars.own = &avatar.Hash
+	client.avatars.lock.Unlock()
+
+	err = client.sendSelfPresence(ctx)
+	if err != nil {
+		return avatar.Hash, fmt.Errorf("unable to announce avatar in presence: %w", err)
+	}
+	return avatar.Hash, nil
+}
+
+// vcardUpdatePayload returns the vcard-temp:x:update element for our presence, or nil before
+// we know our own avatar hash.
+func (client *XmppClient) vcardUpdatePayload() xml.TokenReader {
+	client.avatars.lock.Lock()
+	own := client.avatars.own
+	client.avatars.lock.Unlock()
+	if own == nil {
+		return nil
+	}
+
+	//an empty photo element means we have no avatar
+	return xmlstream.Wrap(
+		xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(*own)),
+			xml.StartElement{Name: xml.Name{Local: "photo"}},
+		),
+		xml.StartElement{Name: xml.Name{Space: "vcard-temp:x:update", Local: "x"}},
+	)
+}
+
+// internalHandleAvatarMetadata handles an avatar metadata notification from PEP
+func (client *XmppClient) internalHandleAvatarMetadata(from jid.JID, items []pepItem) {
+	if len(items) == 0 {
+		return
+	}
+	metadata := AvatarMetadata{}
+	err := items[0].Payload.Decode(&metadata)
+	if err != nil {
+		return
+	}
+
+	hash := ""
+	if len(metadata.Info) > 0 {
+		hash = metadata.Info[0].ID
+	}
+	client.updateAvatarHash(from, hash)
+}
+
+// internalHandleVCardAvatar handles the avatar hash announced in a presence as per https://xmpp.org/extensions/xep-0153.html#presence
+func (client *XmppClient) internalHandleVCardAvatar(from jid.JID, update *VCardUpdate) {
+	if update == nil {
+		return
+	}
+	client.updateAvatarHash(from, strings.TrimSpace(update.Photo))
+}
+
+// updateAvatarHash records the avatar hash of an entity and emits to the handler when it changed.
+func (client *XmppClient) updateAvatarHash(from jid.JID, hash string) {
+	client.avatars.lock.Lock()
+	previous, known := client.avatars.hashes[from.String()]
+	client.avatars.hashes[from.String()] = hash
+	client.avatars.lock.Unlock()
+	if known && previous == hash {
+		return
+	}
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.AvatarHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, from, hash)
+	}
+}
+
+// scaleDown shrinks img to fit in a square of size pixels, averaging the pixels that are merged.
+// Images that already fit are returned unchanged.
+func scaleDown(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	//keep the aspect ratio
+	newW, newH := size, size
+	if w > h {
+		newH = max(1, h*size/w)
+	} else {
+		newW = max(1, w*size/h)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, newW, newH))
+	for y := 0; y < newH; y++ {
+		y0 := bounds.Min.Y + y*h/newH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*h/newH)
+		for x := 0; x < newW; x++ {
+			x0 := bounds.Min.X + x*w/newW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*w/newW)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+
+			//colors are premultiplied, so undo that for the non-premultiplied output
+			i := dst.PixOffset(x, y)
+			if a == 0 {
+				continue
+			}
+			dst.Pix[i+0] = uint8(r * 0xff / a)
+			dst.Pix[i+1] = uint8(g * 0xff / a)
+			dst.Pix[i+2] = uint8(b * 0xff / a)
+			dst.Pix[i+3] = uint8(a / n >> 8)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,268 @@
+package oasis_sdk
+
+// blocking.go implements the blocking command as per https://xmpp.org/extensions/xep-0191.html
+// and attaching spam and abuse reports when blocking as per https://xmpp.org/extensions/xep-0377.html
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/blocklist"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// ReportReason is the reason attached to a report, as per https://xmpp.org/extensions/xep-0377.html#payload
+type ReportReason = blocklist.ReportReason
+
+const (
+	// ReportSpam reports a JID that is sending unwanted messages
+	ReportSpam = blocklist.ReasonSpam
+	// ReportAbuse reports general abuse
+	ReportAbuse = blocklist.ReasonAbuse
+)
+
+// ------ mellium routing namespaces -------
+var blockPushNS = xml.Name{
+	Space: nsBlocking,
+	Local: "block",
+}
+var unblockPushNS = xml.Name{
+	Space: nsBlocking,
+	Local: "unblock",
+}
+
+// BlockReport is a JID to block together with an optional report to the server operator.
+type BlockReport struct {
+	JID       jid.JID
+	Reason    ReportReason // empty to block without reporting
+	Text      string       // optional, only sent with a reason
+	StanzaIDs []stanza.ID  // optional, the offending messages as stamped by the server
+}
+
+// blockListState is our cached copy of the block list on the server
+type blockListState struct {
+	lock    sync.RWMutex
+	jids    map[string]jid.JID
+	fetched bool
+}
+
+type blockPushItem struct {
+	JID string `xml:"jid,attr"`
+}
+
+type blockPush struct {
+	Items []blockPushItem `xml:"item"`
+}
+
+// SetBlockListHandler sets the handler function called when the block list changes,
+// including changes made by our other devices.
+func (client *XmppClient) SetBlockListHandler(handler BlockListHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.BlockListHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// Block adds JIDs to our block list on the server.
+// A bare domain blocks everyone on it, as per https://xmpp.org/extensions/xep-0191.html#matching
+func (client *XmppClient) Block(ctx context.Context, jids ...jid.JID) error {
+	if len(jids) == 0 {
+		return nil
+	}
+	err := blocklist.Add(ctx, client.Session, jids...)
+	if err != nil {
+		return fmt.Errorf("unable to block: %w", err)
+	}
+	client.updateBlockList(jids, nil, false)
+	return nil
+}
+
+// BlockAndReport blocks JIDs like Block, attaching a spam or abuse report to every entry that has a reason.
+func (client *XmppClient) BlockAndReport(ctx context.Context, reports ...BlockReport) error {
+	if len(reports) == 0 {
+		return nil
+	}
+	payload := make([]blocklist.Item, 0, len(reports))
+	jids := make([]jid.JID, 0, len(reports))
+	for _, report := range reports {
+		item := blocklist.Item{
+			JID:    report.JID,
+			Reason: report.Reason,
+		}
+		//the text and stanza ids only make sense as part of a report
+		if report.Reason != "" {
+			item.Text = report.Text
+			item.StanzaIDs = report.StanzaIDs
+		}
+		payload = append(payload, item)
+		jids = append(jids, report.JID)
+	}
+	err := blocklist.Report(ctx, client.Session, payload...)
+	if err != nil {
+		return fmt.Errorf("unable to block and report: %w", err)
+	}
+	client.updateBlockList(jids, nil, false)
+	return nil
+}
+
+// Unblock removes JIDs from our block list on the server.
+// Calling it without any JIDs clears the whole block list.
+func (client *XmppClient) Unblock(ctx context.Context, jids ...jid.JID) error {
+	err := blocklist.Remove(ctx, client.Session, jids...)
+	if err != nil {
+		return fmt.Errorf("unable to unblock: %w", err)
+	}
+	client.updateBlockList(nil, jids, len(jids) == 0)
+	return nil
+}
+
+// BlockList returns the JIDs on our block list, fetching it from the server the first time.
+func (client *XmppClient) BlockList(ctx context.Context) ([]jid.JID, error) {
+	client.blockList.lock.RLock()
+	fetched := client.blockList.fetched
+	client.blockList.lock.RUnlock()
+
+	if !fetched {
+		err := client.fetchBlockList(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client.blockList.lock.RLock()
+	defer client.blockList.lock.RUnlock()
+	res := make([]jid.JID, 0, len(client.blockList.jids))
+	for _, j := range client.blockList.jids {
+		res = append(res, j)
+	}
+	return res, nil
+}
+
+// IsBlocked reports whether j is covered by an entry of the cached block list,
+// matching full JIDs, bare JIDs and domains as per https://xmpp.org/extensions/xep-0191.html#matching
+func (client *XmppClient) IsBlocked(j jid.JID) bool {
+	client.blockList.lock.RLock()
+	defer client.blockList.lock.RUnlock()
+	for _, blocked := range client.blockList.jids {
+		if blocklist.Match(j, blocked) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchBlockList replaces the cached block list with the one on the server.
+// Fetching it also subscribes us to pushes as per https://xmpp.org/extensions/xep-0191.html#push
+func (client *XmppClient) fetchBlockList(ctx context.Context) error {
+	iter := blocklist.Fetch(ctx, client.Session)
+	jids := make(map[string]jid.JID)
+	for iter.Next() {
+		j := iter.JID()
+		jids[j.String()] = j
+	}
+	err := iter.Err()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to fetch block list: %w", err)
+	}
+
+	client.blockList.lock.Lock()
+	client.blockList.jids = jids
+	client.blockList.fetched = true
+	client.blockList.lock.Unlock()
+	return nil
+}
+
+// loadBlockList fetches the block list once discovery shows the server supports it.
+func (client *XmppClient) loadBlockList() {
+	err := client.AwaitDiscovery(client.Ctx)
+	if err != nil || !client.ServerCapabilities().Blocking {
+		return
+	}
+	err = client.fetchBlockList(client.Ctx)
+	if err != nil {
+		fmt.Printf("Could not fetch block list: %v\n", err)
+	}
+}
+
+// updateBlockList applies a change to the cached block list and calls the BlockListHandler
+// with what actually changed.
+func (client *XmppClient) updateBlockList(blocked []jid.JID, unblocked []jid.JID, unblockAll bool) {
+	var added, removed []jid.JID
+
+	client.blockList.lock.Lock()
+	if unblockAll {
+		for _, j := range client.blockList.jids {
+			removed = append(removed, j)
+		}
+		client.blockList.jids = make(map[string]jid.JID)
+	}
+	for _, j := range blocked {
+		if _, ok := client.blockList.jids[j.String()]; !ok {
+			client.blockList.jids[j.String()] = j
+			added = append(added, j)
+		}
+	}
+	for _, j := range unblocked {
+		if _, ok := client.blockList.jids[j.String()]; ok {
+			delete(client.blockList.jids, j.String())
+			removed = append(removed, j)
+		}
+	}
+	client.blockList.lock.Unlock()
+
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.BlockListHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, added, removed)
+	}
+}
+
+// internalHandleBlockPush handles the server telling us the block list changed, usually from another device.
+func (client *XmppClient) internalHandleBlockPush(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	//only our own server may change our block list
+	if !iq.From.Equal(jid.JID{}) && !iq.From.Equal(client.JID.Bare()) {
+		_, err := xmlstream.Copy(t, iq.Error(stanza.Error{
+			Type:      stanza.Cancel,
+			Condition: stanza.Forbidden,
+		}))
+		return err
+	}
+
+	push := blockPush{}
+	err := xml.NewTokenDecoder(t).DecodeElement(&push, start)
+	if err != nil {
+		return err
+	}
+
+	var jids []jid.JID
+	for _, item := range push.Items {
+		j, err := jid.Parse(item.JID)
+		if err != nil {
+			continue
+		}
+		jids = append(jids, j)
+	}
+
+	if start.Name.Local == "block" {
+		client.updateBlockList(jids, nil, false)
+	} else {
+		//an unblock push without items means the whole list was cleared
+		client.updateBlockList(nil, jids, len(push.Items) == 0)
+	}
+
+	_, err = xmlstream.Copy(t, iq.Result(nil))
+	return err
+}
@@ -1,14 +1,52 @@
 package oasis_sdk
 
 import (
+	"bytes"
 	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
 
 	"mellium.im/xmpp/bookmarks"
 	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/pubsub"
 )
 
+// BookmarkEventType is what happened to a bookmark
+type BookmarkEventType int
+
+const (
+	// BookmarkAdded is a bookmark we didn't know about, including every bookmark on the first fetch
+	BookmarkAdded BookmarkEventType = iota
+	// BookmarkChanged is a bookmark that differs from what we knew, BookmarkEvent.Previous holds the old one
+	BookmarkChanged
+	// BookmarkRemoved is a bookmark that was deleted, BookmarkEvent.Bookmark holds the last known one
+	BookmarkRemoved
+)
+
+// bookmarkConference is a bookmark as stored on the server. mellium keeps extensions as raw bytes
+// it can only fill from a byte stream and writes back with doubled namespace declarations, so the
+// extensions are kept token by token instead.
+type bookmarkConference struct {
+	XMLName    xml.Name `xml:"urn:xmpp:bookmarks:1 conference"`
+	Name       string   `xml:"name,attr,omitempty"`
+	Autojoin   bool     `xml:"autojoin,attr"`
+	Nick       string   `xml:"nick,omitempty"`
+	Password   string   `xml:"password,omitempty"`
+	Extensions *struct {
+		Items []rawXML `xml:",any"`
+	} `xml:"extensions"`
+}
+
+// BookmarkEvent is a change to our bookmarks, made by us or by another of our devices
+type BookmarkEvent struct {
+	Type     BookmarkEventType
+	Bookmark bookmarks.Channel
+	Previous *bookmarks.Channel // set for BookmarkChanged
+}
+
+// SetBookmarkHandler sets the handler function called when bookmarks are added, changed or removed.
+// With reEmit every known bookmark is fetched again and emitted as added.
 func (client *XmppClient) SetBookmarkHandler(reEmit bool, handler BookmarkHandler) {
 	//set handler
 	client.handlers.Lock.Lock()
@@ -23,7 +61,8 @@ func (client *XmppClient) SetBookmarkHandler(reEmit bool, handler BookmarkHandle
 	client.bookmarkLock.RUnlock()
 }
 
-// RefreshBookmarks updates the internal bookmark cache by fetching the latest bookmarks from the server, then returns that cache
+// RefreshBookmarks updates the internal bookmark cache by fetching the latest bookmarks from the server, then returns that cache.
+// Differences to the previous cache are emitted to the BookmarkHandler, with reEmit unchanged bookmarks are emitted as well.
 func (client *XmppClient) RefreshBookmarks(reEmit bool) map[string]bookmarks.Channel {
 	client.fetchBookmarks(reEmit)
 	return client.BookmarkCache()
@@ -41,105 +80,348 @@ func (client *XmppClient) BookmarkCache() map[string]bookmarks.Channel {
 }
 
 // fetchBookmarks synchronizes the client's bookmarks with the server and updates the local cache efficiently.
-// It acquires necessary locks for safe concurrent access and emits bookmarks to a registered handler if available.
-func (client *XmppClient) fetchBookmarks(emit bool) {
+// Changes to the cache are emitted to the BookmarkHandler, with reEmit unchanged bookmarks are emitted as added too.
+// Servers without modern bookmarks are read from legacy storage instead.
+func (client *XmppClient) fetchBookmarks(reEmit bool) {
 
 	client.AwaitStart()
 
-	//fetch
-	iter := bookmarks.Fetch(client.Ctx, client.Session)
+	//fetch into a new cache, the old one stays in use until the fetch succeeded
+	var fetched map[string]bookmarks.Channel
+	var err error
+	storage := client.bookmarkStorage()
+	if storage == BookmarkStoragePEP {
+		fetched, err = client.fetchModernBookmarks(client.Ctx)
+	} else {
+		fetched, err = client.fetchLegacyBookmarks(client.Ctx, storage)
+	}
+	if err != nil {
+		fmt.Printf("Could not fetch bookmarks: %v\n", err)
+		return
+	}
 
-	//clear cache and prepare to write
-	client.bookmarkLock.Lock()
-	client.bookmarks = make(map[string]bookmarks.Channel)
+	client.emitBookmarkEvents(client.replaceBookmarks(fetched, reEmit))
+}
+
+// fetchModernBookmarks fetches every bookmark from the bookmarks PEP node, keyed by room JID
+func (client *XmppClient) fetchModernBookmarks(ctx context.Context) (map[string]bookmarks.Channel, error) {
+	//fetch
+	iter := pubsub.Fetch(ctx, client.Session, pubsub.Query{Node: bookmarks.NS})
 
 	//scan
+	fetched := make(map[string]bookmarks.Channel)
 	for iter.Next() {
 		//get this bookmark
-		bookmark := iter.Bookmark()
-		fmt.Println("bookmark", bookmark)
-		client.bookmarks[bookmark.JID.String()] = bookmark
+		id, r := iter.Item()
+		if r == nil {
+			continue
+		}
+		payload := rawXML{}
+		err := xml.NewTokenDecoder(r).Decode(&payload)
+		if err != nil {
+			continue
+		}
+		bookmark, err := decodeBookmark(id, payload)
+		if err != nil {
+			continue
+		}
+		fetched[bookmark.JID.String()] = bookmark
 	}
-	err := iter.Close()
-	fmt.Println("bookmark closing", err)
-
-	//done writing
-	client.bookmarkLock.Unlock()
-
-	//only emit to handler if we should
-	if !emit {
-		return
+	err := iter.Err()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
 	}
+	return fetched, err
+}
 
-	//get bookmark handler
-	client.handlers.Lock.Lock()
-	handler := client.handlers.BookmarkHandler
-	client.handlers.Lock.Unlock()
-	if handler == nil {
-		return
+// replaceBookmarks swaps the cache for a freshly fetched one, returning what changed.
+// With reEmit unchanged bookmarks are returned as added too.
+func (client *XmppClient) replaceBookmarks(fetched map[string]bookmarks.Channel, reEmit bool) []BookmarkEvent {
+	var events []BookmarkEvent
+	client.bookmarkLock.Lock()
+	defer client.bookmarkLock.Unlock()
+	for jidStr, bookmark := range fetched {
+		previous, ok := client.bookmarks[jidStr]
+		if event, changed := bookmarkDiff(previous, ok, bookmark); changed {
+			events = append(events, event)
+		} else if reEmit {
+			events = append(events, BookmarkEvent{Type: BookmarkAdded, Bookmark: bookmark})
+		}
 	}
-
-	//switch to reading lock
-	client.bookmarkLock.RLock()
-	defer client.bookmarkLock.RUnlock()
-
-	//emit every bookmark
-	for _, channel := range client.bookmarks {
-		handler(client, channel)
+	for jidStr, previous := range client.bookmarks {
+		if _, ok := fetched[jidStr]; !ok {
+			events = append(events, BookmarkEvent{Type: BookmarkRemoved, Bookmark: previous})
+		}
 	}
+	client.bookmarks = fetched
+	return events
 }
 
 // PublishBookmark publishes a bookmark for the given channel using the existing client session within the provided context.
 func (client *XmppClient) PublishBookmark(channel bookmarks.Channel, ctx context.Context) error {
 
+	//update local cache first, so the notification of our own change isn't taken for one from another device
+	previous, existed, event, changed := client.storeBookmark(channel)
+
 	//push to server
-	err := bookmarks.Publish(ctx, client.Session, channel)
+	var err error
+	if storage := client.bookmarkStorage(); storage == BookmarkStoragePEP {
+		err = client.publishModernBookmark(ctx, channel)
+	} else {
+		err = client.publishLegacyBookmark(ctx, storage, channel, false)
+	}
 	if err != nil {
+		client.restoreBookmark(channel.JID, previous, existed)
 		return err
 	}
 
-	//update local cache
-	client.bookmarkLock.Lock()
-	defer client.bookmarkLock.Unlock()
-	client.bookmarks[channel.JID.String()] = channel
-
+	if changed {
+		client.emitBookmarkEvents([]BookmarkEvent{event})
+	}
 	return nil
 }
 
 // DeleteBookmark removes a bookmark for the specified JID in the existing client session using the provided context.
 func (client *XmppClient) DeleteBookmark(jid jid.JID, ctx context.Context) error {
+	//update local cache first, so the notification of our own change isn't taken for one from another device
+	client.bookmarkLock.Lock()
+	previous, existed := client.bookmarks[jid.String()]
+	delete(client.bookmarks, jid.String())
+	client.bookmarkLock.Unlock()
+
 	// delete on server
-	err := bookmarks.Delete(ctx, client.Session, jid)
+	var err error
+	if storage := client.bookmarkStorage(); storage == BookmarkStoragePEP {
+		err = bookmarks.Delete(ctx, client.Session, jid)
+	} else {
+		err = client.publishLegacyBookmark(ctx, storage, bookmarks.Channel{JID: jid}, true)
+	}
 	if err != nil {
+		client.restoreBookmark(jid, previous, existed)
 		return err
 	}
 
-	//update local cache
-	client.bookmarkLock.Lock()
-	defer client.bookmarkLock.Unlock()
-	delete(client.bookmarks, jid.String())
-
+	if existed {
+		client.emitBookmarkEvents([]BookmarkEvent{{Type: BookmarkRemoved, Bookmark: previous}})
+	}
 	return nil
 }
 
 func (client *XmppClient) ToggleAutojoin(jidStr string, autojoin bool, ctx context.Context) error {
-	client.bookmarkLock.Lock()
-	defer client.bookmarkLock.Unlock()
-
 	// assume our local cache is up to date
+	client.bookmarkLock.RLock()
 	bookmark, ok := client.bookmarks[jidStr]
+	client.bookmarkLock.RUnlock()
 	if !ok {
 		return errors.New("bookmark not found")
 	}
 
 	//update bookmark
 	bookmark.Autojoin = autojoin
-	client.bookmarks[jidStr] = bookmark
 
 	//publish bookmark to server
-	err := bookmarks.Publish(ctx, client.Session, bookmark)
+	err := client.PublishBookmark(bookmark, ctx)
 	if err != nil {
 		return fmt.Errorf("unable to push bookmark: %w", err)
 	}
 	return nil
 }
+
+// publishModernBookmark publishes a bookmark to the bookmarks PEP node, extensions included
+func (client *XmppClient) publishModernBookmark(ctx context.Context, channel bookmarks.Channel) error {
+	conference := bookmarkConference{
+		Name:     channel.Name,
+		Autojoin: channel.Autojoin,
+		Nick:     channel.Nick,
+		Password: channel.Password,
+	}
+	if extensions := bookmarkExtensions(channel); len(extensions) > 0 {
+		conference.Extensions = &struct {
+			Items []rawXML `xml:",any"`
+		}{Items: extensions}
+	}
+	item, err := marshalTokens(conference)
+	if err != nil {
+		return err
+	}
+	_, err = pubsub.Publish(ctx, client.Session, bookmarks.NS, channel.JID.Bare().String(), item)
+	return err
+}
+
+// decodeBookmark decodes the payload of a bookmarks PEP item, the item id is the room JID
+func decodeBookmark(id string, payload rawXML) (bookmarks.Channel, error) {
+	j, err := jid.Parse(id)
+	if err != nil {
+		return bookmarks.Channel{}, err
+	}
+	conference := bookmarkConference{}
+	err = payload.Decode(&conference)
+	if err != nil {
+		return bookmarks.Channel{}, err
+	}
+	channel := bookmarks.Channel{
+		JID:      j,
+		Autojoin: conference.Autojoin,
+		Name:     conference.Name,
+		Nick:     conference.Nick,
+		Password: conference.Password,
+	}
+	if conference.Extensions != nil {
+		setBookmarkExtensions(&channel, conference.Extensions.Items)
+	}
+	return channel, nil
+}
+
+// bookmarkExtensions splits the extensions of a bookmark into their elements
+func bookmarkExtensions(channel bookmarks.Channel) []rawXML {
+	var res []rawXML
+	d := xml.NewDecoder(bytes.NewReader(channel.Extensions))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		extension := rawXML{}
+		if d.DecodeElement(&extension, &start) != nil {
+			break
+		}
+		res = append(res, extension)
+	}
+	return res
+}
+
+// setBookmarkExtensions replaces the extensions of a bookmark with the given elements
+func setBookmarkExtensions(channel *bookmarks.Channel, extensions []rawXML) {
+	channel.Extensions = nil
+	for _, extension := range extensions {
+		data, err := xml.Marshal(extension)
+		if err != nil {
+			continue
+		}
+		channel.Extensions = append(channel.Extensions, data...)
+	}
+}
+
+// storeBookmark puts a bookmark in the cache, returning what it replaced and the resulting event
+func (client *XmppClient) storeBookmark(bookmark bookmarks.Channel) (bookmarks.Channel, bool, BookmarkEvent, bool) {
+	client.bookmarkLock.Lock()
+	defer client.bookmarkLock.Unlock()
+	previous, existed := client.bookmarks[bookmark.JID.String()]
+	client.bookmarks[bookmark.JID.String()] = bookmark
+	event, changed := bookmarkDiff(previous, existed, bookmark)
+	return previous, existed, event, changed
+}
+
+// restoreBookmark undoes a cache update after the server refused it
+func (client *XmppClient) restoreBookmark(j jid.JID, previous bookmarks.Channel, existed bool) {
+	client.bookmarkLock.Lock()
+	defer client.bookmarkLock.Unlock()
+	if existed {
+		client.bookmarks[j.String()] = previous
+	} else {
+		delete(client.bookmarks, j.String())
+	}
+}
+
+// bookmarkDiff works out the event for replacing previous, if it existed, with bookmark.
+// Returns false if nothing changed.
+func bookmarkDiff(previous bookmarks.Channel, existed bool, bookmark bookmarks.Channel) (BookmarkEvent, bool) {
+	if !existed {
+		return BookmarkEvent{Type: BookmarkAdded, Bookmark: bookmark}, true
+	}
+	if previous.Autojoin == bookmark.Autojoin && previous.Name == bookmark.Name && previous.Nick == bookmark.Nick &&
+		previous.Password == bookmark.Password && bytes.Equal(previous.Extensions, bookmark.Extensions) {
+		return BookmarkEvent{}, false
+	}
+	return BookmarkEvent{Type: BookmarkChanged, Bookmark: bookmark, Previous: &previous}, true
+}
+
+// emitBookmarkEvents hands bookmark changes to the BookmarkHandler
+func (client *XmppClient) emitBookmarkEvents(events []BookmarkEvent) {
+	//get bookmark handler
+	client.handlers.Lock.Lock()
+	handler := client.handlers.BookmarkHandler
+	client.handlers.Lock.Unlock()
+	if handler == nil {
+		return
+	}
+
+	//emit every event
+	for _, event := range events {
+		handler(client, event)
+	}
+}
+
+// internalHandleBookmarkEvent applies bookmark changes made by our other devices, as per
+// https://xmpp.org/extensions/xep-0402.html#notify, joining or leaving rooms whose autojoin changed.
+func (client *XmppClient) internalHandleBookmarkEvent(from jid.JID, items pepItems) {
+	//only our own bookmarks are of interest
+	if !from.Equal(client.JID.Bare()) {
+		return
+	}
+
+	var events []BookmarkEvent
+	for _, item := range items.Items {
+		bookmark, err := decodeBookmark(item.ID, item.Payload)
+		if err != nil {
+			continue
+		}
+
+		_, _, event, changed := client.storeBookmark(bookmark)
+		if changed {
+			events = append(events, event)
+		}
+	}
+	for _, retract := range items.Retract {
+		client.bookmarkLock.Lock()
+		previous, ok := client.bookmarks[retract.ID]
+		delete(client.bookmarks, retract.ID)
+		client.bookmarkLock.Unlock()
+		if ok {
+			events = append(events, BookmarkEvent{Type: BookmarkRemoved, Bookmark: previous})
+		}
+	}
+
+	client.applyRemoteBookmarkEvents(events)
+}
+
+// applyRemoteBookmarkEvents follows autojoin changes made by our other devices, then emits the changes
+func (client *XmppClient) applyRemoteBookmarkEvents(events []BookmarkEvent) {
+	for _, event := range events {
+		go client.followAutojoin(event)
+	}
+	client.emitBookmarkEvents(events)
+}
+
+// followAutojoin joins or leaves a room after another device changed whether it should be joined
+func (client *XmppClient) followAutojoin(event BookmarkEvent) {
+	level := client.AutojoinLevel.Load()
+	if level == AutojoinNone {
+		return
+	}
+	wanted := func(bookmark bookmarks.Channel) bool {
+		return level == AutojoinAll || bookmark.Autojoin
+	}
+
+	room := event.Bookmark.JID.Bare()
+	client.mucLock.RLock()
+	_, joined := client.MucChannels[room.String()]
+	client.mucLock.RUnlock()
+
+	switch {
+	case event.Type != BookmarkRemoved && wanted(event.Bookmark) && !joined:
+		client.autojoin(event.Bookmark)
+	case event.Type == BookmarkChanged && wanted(*event.Previous) && !wanted(event.Bookmark) && joined,
+		event.Type == BookmarkRemoved && wanted(event.Bookmark) && joined:
+		ctx, cancel := context.WithTimeout(client.Ctx, autojoinTimeout)
+		defer cancel()
+		err := client.DisconnectMuc(room.String(), "", ctx)
+		if err != nil {
+			fmt.Printf("Could not leave %s: %v\n", room.String(), err)
+		}
+	}
+}
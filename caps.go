@@ -0,0 +1,386 @@
+package oasis_sdk
+
+// caps.go implements Entity Capabilities as per https://xmpp.org/extensions/xep-0115.html
+// and https://xmpp.org/extensions/xep-0390.html. It advertises our own features in
+// outgoing presence and keeps a cache of what features other entities support.
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/crypto"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// capsNode uniquely identifies this sdk in legacy caps as per https://xmpp.org/extensions/xep-0115.html#protocol-node
+const capsNode = "https://github.com/sunglocto/oasis-sdk"
+
+// NSECaps2 is the namespace of https://xmpp.org/extensions/xep-0390.html
+const NSECaps2 = "urn:xmpp:caps"
+
+// capsCacheFile is the name of the persistent caps cache inside LoginInfo.CacheDir
+const capsCacheFile = "caps.json"
+
+// sdkRoute is a group of multiplexer handlers together with the features they make us support.
+// CreateClient builds the multiplexer and our advertised features from one table of these,
+// so peers are only told about what the sdk actually handles.
+type sdkRoute struct {
+	features []string
+	handlers []mux.Option
+}
+
+// ------ mellium routing namespaces -------
+var ecaps2NS = xml.Name{
+	Space: NSECaps2,
+	Local: "c",
+}
+
+// ECaps2Hash is a single hash of the disco#info of an entity
+type ECaps2Hash struct {
+	XMLName xml.Name `xml:"urn:xmpp:hashes:2 hash"`
+	Algo    string   `xml:"algo,attr"`
+	Value   string   `xml:",chardata"`
+}
+
+// ECaps2 is the caps element from https://xmpp.org/extensions/xep-0390.html#protocol
+type ECaps2 struct {
+	XMLName xml.Name     `xml:"urn:xmpp:caps c"`
+	Hashes  []ECaps2Hash `xml:"hash"`
+}
+
+// capsRef points from an entity to the cache key of its advertised features
+type capsRef struct {
+	key    string
+	algo   string
+	ver    string
+	ecaps2 bool
+}
+
+// capsCache is the mapping from caps hashes to feature lists, and from full JIDs to caps hashes
+type capsCache struct {
+	lock     sync.RWMutex
+	features map[string][]string
+	entities map[string]capsRef
+	pending  map[string]struct{}
+}
+
+// capsVer returns the legacy sha-1 verification string as per https://xmpp.org/extensions/xep-0115.html#ver
+func (client *XmppClient) capsVer() string {
+	return client.ourInfo().Hash(sha1.New())
+}
+
+// ecaps2Ver returns the sha-256 hash as per https://xmpp.org/extensions/xep-0390.html#algorithm
+func (client *XmppClient) ecaps2Ver() string {
+	sum := sha256.Sum256(ecaps2Input(client.ourInfo()))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// capsPayload returns the caps elements to attach to our outgoing presence
+func (client *XmppClient) capsPayload() xml.TokenReader {
+	legacy := disco.Caps{
+		Hash: crypto.SHA1,
+		Node: capsNode,
+		Ver:  client.capsVer(),
+	}
+	ecaps2 := xmlstream.Wrap(
+		xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(client.ecaps2Ver())),
+			xml.StartElement{
+				Name: xml.Name{Space: crypto.NS, Local: "hash"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "algo"}, Value: "sha-256"}},
+			},
+		),
+		xml.StartElement{Name: xml.Name{Space: NSECaps2, Local: "c"}},
+	)
+	return xmlstream.MultiReader(legacy.TokenReader(), ecaps2)
+}
+
+// refreshCaps re-sends our presence so contacts pick up a changed verification string.
+func (client *XmppClient) refreshCaps() {
+	//nothing to refresh before we're connected, the first presence will have it
+	if client.Session == nil {
+		return
+	}
+	err := client.sendSelfPresence(client.Ctx)
+	if err != nil {
+		fmt.Printf("Could not refresh caps: %v\n", err)
+	}
+}
+
+// ecaps2Input builds the byte string that is hashed for https://xmpp.org/extensions/xep-0390.html#algorithm-input
+func ecaps2Input(i disco.Info) []byte {
+	features := make([]string, 0, len(i.Features))
+	for _, f := range i.Features {
+		features = append(features, f.Var+"\x1f")
+	}
+	sort.Strings(features)
+
+	identities := make([]string, 0, len(i.Identity))
+	for _, ident := range i.Identity {
+		identities = append(identities,
+			ident.Category+"\x1f"+ident.Type+"\x1f"+ident.Lang+"\x1f"+ident.Name+"\x1f\x1e")
+	}
+	sort.Strings(identities)
+
+	forms := make([]string, 0, len(i.Form))
+	for _, data := range i.Form {
+		fields := make([]string, 0, data.Len())
+		data.ForFields(func(f form.FieldData) {
+			values, _ := data.Raw(f.Var)
+			sorted := make([]string, 0, len(values))
+			for _, v := range values {
+				sorted = append(sorted, v+"\x1f")
+			}
+			sort.Strings(sorted)
+			fields = append(fields, f.Var+"\x1f"+strings.Join(sorted, "")+"\x1e")
+		})
+		sort.Strings(fields)
+		forms = append(forms, strings.Join(fields, "")+"\x1d")
+	}
+	sort.Strings(forms)
+
+	return []byte(strings.Join(features, "") + "\x1c" +
+		strings.Join(identities, "") + "\x1c" +
+		strings.Join(forms, "") + "\x1c")
+}
+
+// internalHandleCapsPresence records the legacy caps of an entity and queries its features if unknown.
+func (client *XmppClient) internalHandleCapsPresence(header stanza.Presence, caps disco.Caps) {
+	if caps.Ver == "" || !caps.Hash.Available() {
+		return
+	}
+	client.trackCaps(header.From, capsRef{
+		key:  caps.Hash.String() + "." + caps.Ver,
+		algo: caps.Hash.String(),
+		ver:  caps.Ver,
+	}, caps.Node+"#"+caps.Ver)
+}
+
+// internalHandleECaps2Presence records the XEP-0390 caps of an entity and queries its features if unknown.
+func (client *XmppClient) internalHandleECaps2Presence(header stanza.Presence, t xmlstream.TokenReadEncoder) error {
+	d := xml.NewTokenDecoder(t)
+	body := struct {
+		stanza.Presence
+		ECaps2 ECaps2 `xml:"urn:xmpp:caps c"`
+	}{}
+	err := d.Decode(&body)
+	if err != nil {
+		return err
+	}
+
+	//only sha-256 is mandatory to implement, so that's the only one we use
+	for _, h := range body.ECaps2.Hashes {
+		if h.Algo != "sha-256" || h.Value == "" {
+			continue
+		}
+		client.trackCaps(header.From, capsRef{
+			key:    "ecaps2." + h.Algo + "." + h.Value,
+			algo:   h.Algo,
+			ver:    h.Value,
+			ecaps2: true,
+		}, NSECaps2+"#"+h.Algo+"."+h.Value)
+		break
+	}
+	return nil
+}
+
+// internalHandleUnavailableCaps forgets the caps of an entity that went offline.
+// The mux only calls it for presences no other route takes, room occupants are forgotten in internalHandleMucPresence.
+func (client *XmppClient) internalHandleUnavailableCaps(header stanza.Presence, _ xmlstream.TokenReadEncoder) error {
+	client.forgetCaps(header.From)
+	return nil
+}
+
+// forgetCaps forgets the caps of an entity that went offline
+func (client *XmppClient) forgetCaps(from jid.JID) {
+	client.caps.lock.Lock()
+	delete(client.caps.entities, from.String())
+	client.caps.lock.Unlock()
+}
+
+// forgetRoomCaps forgets the caps of every occupant of a room we left, whose own leaving we won't see
+func (client *XmppClient) forgetRoomCaps(room jid.JID) {
+	prefix := room.Bare().String() + "/"
+	client.caps.lock.Lock()
+	for entity := range client.caps.entities {
+		if strings.HasPrefix(entity, prefix) {
+			delete(client.caps.entities, entity)
+		}
+	}
+	client.caps.lock.Unlock()
+}
+
+// trackCaps links an entity to a caps key, and fetches the features behind it when we don't know them yet.
+func (client *XmppClient) trackCaps(from jid.JID, ref capsRef, node string) {
+	client.caps.lock.Lock()
+	//ecaps2 takes priority over legacy caps when both are sent
+	existing, ok := client.caps.entities[from.String()]
+	if !ok || ref.ecaps2 || !existing.ecaps2 {
+		client.caps.entities[from.String()] = ref
+	}
+	_, known := client.caps.features[ref.key]
+	_, pending := client.caps.pending[ref.key]
+	if known || pending {
+		client.caps.lock.Unlock()
+		return
+	}
+	client.caps.pending[ref.key] = struct{}{}
+	client.caps.lock.Unlock()
+
+	go client.fetchCaps(from, ref, node)
+}
+
+// fetchCaps queries the disco#info behind a caps node, verifies it against the hash and stores it in the cache.
+func (client *XmppClient) fetchCaps(from jid.JID, ref capsRef, node string) {
+	defer func() {
+		client.caps.lock.Lock()
+		delete(client.caps.pending, ref.key)
+		client.caps.lock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(client.Ctx, 30*time.Second)
+	defer cancel()
+
+	discoInfo, err := disco.GetInfo(ctx, node, from, client.Session)
+	if err != nil {
+		fmt.Printf("Error while getting caps of %s, %v\n", from.String(), err)
+		return
+	}
+
+	//never cache a hash that doesn't match, or anyone could poison the cache
+	h, err := crypto.Parse(ref.algo)
+	if err != nil || !h.Available() {
+		return
+	}
+	var ver string
+	if ref.ecaps2 {
+		hasher := h.New()
+		hasher.Write(ecaps2Input(discoInfo))
+		ver = base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+	} else {
+		ver = discoInfo.Hash(h.New())
+	}
+	if ver != ref.ver {
+		fmt.Printf("Caps hash mismatch for %s, want %s, have %s\n", from.String(), ref.ver, ver)
+		return
+	}
+
+	features := make([]string, 0, len(discoInfo.Features))
+	for _, f := range discoInfo.Features {
+		features = append(features, f.Var)
+	}
+
+	client.caps.lock.Lock()
+	client.caps.features[ref.key] = features
+	client.caps.lock.Unlock()
+
+	client.saveCapsCache()
+}
+
+// loadCapsCache reads the persistent caps cache from LoginInfo.CacheDir, if one is configured.
+func (client *XmppClient) loadCapsCache() {
+	if client.Login.CacheDir == "" {
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(client.Login.CacheDir, capsCacheFile))
+	if err != nil {
+		return
+	}
+
+	features := make(map[string][]string)
+	err = json.Unmarshal(data, &features)
+	if err != nil {
+		fmt.Printf("Could not parse caps cache: %v\n", err)
+		return
+	}
+
+	client.caps.lock.Lock()
+	for key, list := range features {
+		client.caps.features[key] = list
+	}
+	client.caps.lock.Unlock()
+}
+
+// saveCapsCache writes the caps cache to LoginInfo.CacheDir, if one is configured.
+func (client *XmppClient) saveCapsCache() {
+	if client.Login.CacheDir == "" {
+		return
+	}
+
+	client.caps.lock.RLock()
+	data, err := json.Marshal(client.caps.features)
+	client.caps.lock.RUnlock()
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(client.Login.CacheDir, 0o700)
+	if err != nil {
+		fmt.Printf("Could not create cache dir: %v\n", err)
+		return
+	}
+	err = os.WriteFile(filepath.Join(client.Login.CacheDir, capsCacheFile), data, 0o600)
+	if err != nil {
+		fmt.Printf("Could not write caps cache: %v\n", err)
+	}
+}
+
+// SupportsFeature reports whether the entity at fullJID advertised the feature ns in its caps.
+// It only consults the caps cache and never sends a query, so it returns false for entities
+// whose caps haven't been received or resolved yet.
+func (client *XmppClient) SupportsFeature(fullJID jid.JID, ns string) bool {
+	client.caps.lock.RLock()
+	defer client.caps.lock.RUnlock()
+
+	ref, ok := client.caps.entities[fullJID.String()]
+	if !ok {
+		return false
+	}
+	for _, feature := range client.caps.features[ref.key] {
+		if feature == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsFeatureAnyResource is like SupportsFeature, but for a bare JID it reports whether
+// any of its resources we know of advertised the feature.
+func (client *XmppClient) supportsFeatureAnyResource(j jid.JID, ns string) bool {
+	if j.Resourcepart() != "" {
+		return client.SupportsFeature(j, ns)
+	}
+
+	client.caps.lock.RLock()
+	var resources []jid.JID
+	for entity := range client.caps.entities {
+		full, err := jid.Parse(entity)
+		if err == nil && full.Bare().Equal(j) {
+			resources = append(resources, full)
+		}
+	}
+	client.caps.lock.RUnlock()
+
+	for _, full := range resources {
+		if client.SupportsFeature(full, ns) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,99 +1,359 @@
 package oasis_sdk
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"strconv"
+	"sync"
+	"time"
 
-	"golang.org/x/net/context"
 	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
 	"mellium.im/xmpp/disco/items"
 	jid2 "mellium.im/xmpp/jid"
 )
 
+// discoInfoCacheTTL is how long a disco#info result is reused before querying again
+const discoInfoCacheTTL = 10 * time.Minute
+
+// discoWorkers is how many server items are queried at the same time during discovery
+const discoWorkers = 8
+
+// discoItemTimeout is how long a single item may take to answer before it is skipped
+const discoItemTimeout = 10 * time.Second
+
+// namespaces of server features reported in ServerCapabilities
+const (
+	nsMAM              = "urn:xmpp:mam:2"
+	nsCarbons          = "urn:xmpp:carbons:2"
+	nsPush             = "urn:xmpp:push:0"
+	nsBlocking         = "urn:xmpp:blocking"
+	nsCSI              = "urn:xmpp:csi:0"
+	nsStreamManagement = "urn:xmpp:sm:3"
+	nsHttpUpload       = "urn:xmpp:http:upload:0"
+)
+
+// ServerCapabilities is a typed report of the services and features discovered on our server.
+type ServerCapabilities struct {
+	Features         []string // features of the server itself
+	AccountFeatures  []string // features of our own bare JID, such as MAM and PEP
+	MucServices      []jid2.JID
+	UploadComponents []HttpUploadComponent
+	Proxies          []jid2.JID
+	PubSubService    *jid2.JID
+	MAM              bool
+	Carbons          bool
+	Push             bool
+	Blocking         bool
+	CSI              bool
+	StreamManagement bool
+	Bookmarks        BookmarkStorage // where our bookmarks are kept
+	AccountInfoErr   error           // why the features of our account are unknown, MAM and Bookmarks are then only guesses
+}
+
+// discoCacheEntry is a disco#info result together with when it stops being valid
+type discoCacheEntry struct {
+	info    disco.Info
+	expires time.Time
+}
+
+// discoCache is a TTL cache of disco#info results, keyed by JID and node
+type discoCache struct {
+	lock    sync.Mutex
+	entries map[string]discoCacheEntry
+}
+
+// GetDiscoInfo returns the disco#info of a JID and optional node, reusing a cached result
+// for up to ten minutes instead of querying again.
+func (client *XmppClient) GetDiscoInfo(ctx context.Context, to jid2.JID, node string) (disco.Info, error) {
+	key := to.String() + "#" + node
+
+	client.discoCache.lock.Lock()
+	entry, ok := client.discoCache.entries[key]
+	client.discoCache.lock.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.info, nil
+	}
+
+	result, err := disco.GetInfo(ctx, node, to, client.Session)
+	if err != nil {
+		return result, err
+	}
+
+	client.discoCache.lock.Lock()
+	client.discoCache.entries[key] = discoCacheEntry{
+		info:    result,
+		expires: time.Now().Add(discoInfoCacheTTL),
+	}
+	client.discoCache.lock.Unlock()
+	return result, nil
+}
+
+// InvalidateDiscoInfo drops the cached disco#info of a JID and node, so the next lookup queries again.
+func (client *XmppClient) InvalidateDiscoInfo(to jid2.JID, node string) {
+	client.discoCache.lock.Lock()
+	delete(client.discoCache.entries, to.String()+"#"+node)
+	client.discoCache.lock.Unlock()
+}
+
+// ServerCapabilities returns a copy of what was discovered on the server so far.
+func (client *XmppClient) ServerCapabilities() ServerCapabilities {
+	client.serverCapsLock.RLock()
+	defer client.serverCapsLock.RUnlock()
+
+	res := client.serverCaps
+	res.Features = append([]string(nil), client.serverCaps.Features...)
+	res.AccountFeatures = append([]string(nil), client.serverCaps.AccountFeatures...)
+	res.MucServices = append([]jid2.JID(nil), client.serverCaps.MucServices...)
+	res.UploadComponents = append([]HttpUploadComponent(nil), client.serverCaps.UploadComponents...)
+	res.Proxies = append([]jid2.JID(nil), client.serverCaps.Proxies...)
+	return res
+}
+
+// hasFeature reports whether a disco#info result lists the feature ns
+func hasFeature(discoInfo disco.Info, ns string) bool {
+	for _, f := range discoInfo.Features {
+		if f.Var == ns {
+			return true
+		}
+	}
+	return false
+}
+
+// featureList flattens the features of a disco#info result into their namespaces
+func featureList(features []info.Feature) []string {
+	res := make([]string, 0, len(features))
+	for _, f := range features {
+		res = append(res, f.Var)
+	}
+	return res
+}
+
 /*
 The error result returned by the function controls how WalkItem continues.
 If the function returns the special value ErrSkipItem, WalkItem skips the current item.
 Otherwise, if the function returns a non-nil error, WalkItem stops entirely and returns that error.
 */
 
-// DiscoServerItem handles a server item being discovered. Implements WalkItemFunc
+// DiscoServerItem handles a server item being discovered and records it in the server capabilities.
+// Implements WalkItemFunc
 func (client *XmppClient) DiscoServerItem(level int, item items.Item, err error) error {
 	//fmt.Printf(
 	//	"discovered server item at level %d, name: %s, jid %s, node %v, err %v\n",
 	//	level, item.Name, item.JID.String(), item.Node, err,
 	//)
 
-	info, err := disco.GetInfo(context.Background(), "", item.JID, client.Session)
-	if err != nil {
-		fmt.Printf("Error while getting info about %s, %v\n", item.JID.String(), err)
-	}
+	ctx, cancel := context.WithTimeout(client.Ctx, discoItemTimeout)
+	defer cancel()
+
+	info, err := client.GetDiscoInfo(ctx, item.JID, "")
 
 	// learned this happens when an item is unavailable. oops!
-	if len(info.Identity) < 1 {
+	if err != nil || len(info.Identity) < 1 {
 		return disco.ErrSkipItem
 	}
 
-	identity := info.Identity[0]
-	//fmt.Printf("%s: Type %s, Category %s\n", item.JID.String(), identity.Type, identity.Category)
-
-	if identity.Type == "text" && identity.Category == "conference" {
+	client.serverCapsLock.Lock()
+	defer client.serverCapsLock.Unlock()
+	if classifyServerItem(&client.serverCaps, item, info) {
 		return disco.ErrSkipItem
 	}
+	return nil
+}
 
-	if identity.Type == "file" && identity.Category == "store" {
-		httpUploadComponent := HttpUploadComponent{
-			Jid: item.JID,
-		}
+// classifyServerItem records a discovered item in caps based on its identities.
+// Returns true if the item should not be walked into, such as a muc service.
+func classifyServerItem(caps *ServerCapabilities, item items.Item, info disco.Info) (skip bool) {
+	//components may have more than one identity, so look at all of them
+	for _, identity := range info.Identity {
+		//fmt.Printf("%s: Type %s, Category %s\n", item.JID.String(), identity.Type, identity.Category)
+		switch {
+		case identity.Category == "conference" && identity.Type == "text":
+			caps.MucServices = append(caps.MucServices, item.JID)
+			//never walk into the rooms of a muc service
+			skip = true
 
-		for _, x := range info.Form {
-			v, ok := x.GetString("max-file-size")
-			if ok {
-				//fmt.Printf("max-file-size: %s\n", v)
-				maxFileSize, err := strconv.ParseInt(v, 10, 64)
-				if err != nil {
-					fmt.Printf("Could not parse max-file-size: %v\n", err)
-					maxFileSize = 0
-				}
-				httpUploadComponent.MaxFileSize = int(maxFileSize)
-				break
-				//httpUploadComponent.MaxFileSize
+		case identity.Category == "store" && identity.Type == "file" && uploadNamespaceOf(info) != "":
+			//keep every upload service, older namespaces included, the upload picks one per file
+			caps.UploadComponents = append(caps.UploadComponents, HttpUploadComponent{
+				Jid:         item.JID,
+				MaxFileSize: parseMaxFileSize(info),
+				Namespace:   uploadNamespaceOf(info),
+			})
+
+		case identity.Category == "proxy" && identity.Type == "bytestreams":
+			caps.Proxies = append(caps.Proxies, item.JID)
+
+		case identity.Category == "pubsub" && identity.Type == "service":
+			if caps.PubSubService == nil {
+				pubsub := item.JID
+				caps.PubSubService = &pubsub
 			}
 		}
-
-		client.HttpUploadComponent = &httpUploadComponent
-		fmt.Println(client.HttpUploadComponent)
 	}
-
-	return nil
+	return skip
 }
 
-func (client *XmppClient) DiscoServicesOnSelf() {
+// DiscoServicesOnSelf walks the items on our own account and records them in the server capabilities.
+func (client *XmppClient) DiscoServicesOnSelf() error {
 	item := items.Item{
 		JID:  *client.JID,
 		Name: "self",
 	}
 
-	err := disco.WalkItem(context.Background(), item, client.Session, client.DiscoServerItem)
+	err := disco.WalkItem(client.Ctx, item, client.Session, client.DiscoServerItem)
 	if err != nil {
-		fmt.Printf("Error while walking self items: %v\n", err)
+		return fmt.Errorf("unable to walk self items: %w", err)
+	}
+	return nil
+}
+
+// DiscoServicesOnServer discovers the features of our server and account, and queries the server items
+// in parallel to find components. The results are published all at once when discovery finishes,
+// after which they are available from ServerCapabilities, AwaitDiscovery returns, and the
+// DiscoveryFinishedHandler is called.
+func (client *XmppClient) DiscoServicesOnServer() error {
+	//one run at a time, a reconnect may start one while the last is still waiting on slow components
+	client.discoveryLock.Lock()
+
+	//mark discovery as running, replacing the signal of a previous run
+	client.serverCapsLock.Lock()
+	select {
+	case <-client.discoveryDone:
+		client.discoveryDone = make(chan struct{})
+	default:
 	}
+	done := client.discoveryDone
+	client.serverCapsLock.Unlock()
+
+	caps, err := client.discoverServer()
+
+	//publish atomically so readers never see a half finished report
+	client.serverCapsLock.Lock()
+	client.serverCaps = caps
+	if candidates, err := caps.uploadCandidates(0); err == nil {
+		httpUploadComponent := candidates[0]
+		client.HttpUploadComponent = &httpUploadComponent
+	} else {
+		client.HttpUploadComponent = nil
+	}
+	close(done)
+	client.serverCapsLock.Unlock()
+	//the handler may start discovery again
+	client.discoveryLock.Unlock()
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.DiscoveryFinishedHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, client.ServerCapabilities(), err)
+	}
+	return err
 }
 
-func (client *XmppClient) DiscoServicesOnServer() {
+// discoverServer builds the server capabilities report without touching the published one.
+func (client *XmppClient) discoverServer() (ServerCapabilities, error) {
+	caps := ServerCapabilities{}
+
 	jid, err := jid2.Parse(*client.Server)
 	if err != nil {
-		log.Fatalf("server string \"%s\" not a valid JID, %v", *client.Server, err)
+		return caps, fmt.Errorf("server string \"%s\" not a valid JID: %w", *client.Server, err)
 	}
 
-	item := items.Item{
-		JID:  jid,
-		Name: *client.Server,
+	//features of the server itself
+	serverInfo, err := client.GetDiscoInfo(client.Ctx, jid, "")
+	if err != nil {
+		return caps, fmt.Errorf("unable to get server info: %w", err)
 	}
 
-	err = disco.WalkItem(context.Background(), item, client.Session, client.DiscoServerItem)
+	//features of our account, where MAM and PEP are advertised. Not every server answers this
+	accountInfo, accountErr := client.GetDiscoInfo(client.Ctx, client.JID.Bare(), "")
+
+	//csi and sm are stream features rather than disco features
+	_, csi := client.Session.Feature(nsCSI)
+	_, sm := client.Session.Feature(nsStreamManagement)
+
+	caps.Features = featureList(serverInfo.Features)
+	caps.AccountFeatures = featureList(accountInfo.Features)
+	caps.MAM = hasFeature(accountInfo, nsMAM)
+	caps.Carbons = hasFeature(serverInfo, nsCarbons)
+	caps.Push = hasFeature(accountInfo, nsPush) || hasFeature(serverInfo, nsPush)
+	caps.Blocking = hasFeature(serverInfo, nsBlocking)
+	caps.CSI = csi
+	caps.StreamManagement = sm
+	caps.Bookmarks = bookmarkStorageFor(accountInfo)
+	if accountErr != nil {
+		caps.AccountInfoErr = fmt.Errorf("unable to get account info: %w", accountErr)
+		//without account info assume a modern server, as bookmarkStorage does without discovery
+		caps.Bookmarks = BookmarkStoragePEP
+	}
+
+	//collect the server items first, so they can be queried in parallel
+	iter := disco.FetchItems(client.Ctx, items.Item{JID: jid}, client.Session)
+	var serverItems []items.Item
+	for iter.Next() {
+		serverItems = append(serverItems, iter.Item())
+	}
+	err = iter.Err()
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		fmt.Printf("Error while walking server items: %v\n", err)
+		return caps, fmt.Errorf("unable to fetch server items: %w", err)
+	}
+
+	//bounded worker pool, each item gets its own timeout so one dead component can't stall discovery
+	var capsLock sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan items.Item)
+	for range min(discoWorkers, len(serverItems)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				ctx, cancel := context.WithTimeout(client.Ctx, discoItemTimeout)
+				info, err := client.GetDiscoInfo(ctx, item.JID, item.Node)
+				cancel()
+
+				// learned this happens when an item is unavailable. oops!
+				if err != nil || len(info.Identity) < 1 {
+					continue
+				}
+
+				capsLock.Lock()
+				classifyServerItem(&caps, item, info)
+				capsLock.Unlock()
+			}
+		}()
+	}
+
+	for _, item := range serverItems {
+		select {
+		case queue <- item:
+		case <-client.Ctx.Done():
+		}
 	}
+	close(queue)
+	wg.Wait()
 
+	if err := client.Ctx.Err(); err != nil {
+		return caps, err
+	}
+	return caps, nil
+}
+
+// AwaitDiscovery blocks until the current service discovery on the server has finished,
+// or ctx is done. Use this before relying on ServerCapabilities, for example before uploading.
+func (client *XmppClient) AwaitDiscovery(ctx context.Context) error {
+	client.serverCapsLock.RLock()
+	done := client.discoveryDone
+	client.serverCapsLock.RUnlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,216 @@
+package oasis_sdk
+
+// discoResponder.go answers service discovery queries sent to us as per
+// https://xmpp.org/extensions/xep-0030.html, so other entities know what we support.
+
+import (
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/stanza"
+)
+
+// defaultClientName is the identity name used when LoginInfo.ClientName is empty
+const defaultClientName = "Oasis"
+
+// ------ mellium routing namespaces -------
+var discoInfoNS = xml.Name{
+	Space: disco.NSInfo,
+	Local: "query",
+}
+var discoItemsNS = xml.Name{
+	Space: disco.NSItems,
+	Local: "query",
+}
+
+// DiscoNode is an additional node answered by our disco responder, such as one used by ad-hoc commands.
+// Every registered node is listed in the disco#items of our own JID.
+type DiscoNode struct {
+	Name       string
+	Identities []info.Identity
+	Features   []string
+	Items      []items.Item
+}
+
+// discoResponderState holds what we advertise about ourselves
+type discoResponderState struct {
+	lock     sync.RWMutex
+	features map[string]struct{}
+	sdk      map[string]struct{} //features of the sdk's own handlers, set once in CreateClient
+	nodes    map[string]DiscoNode
+}
+
+// RegisterFeatures advertises extra namespaces in our disco#info and caps.
+// Use this when the application handles a protocol on its own, so peers know to send it.
+func (client *XmppClient) RegisterFeatures(namespaces ...string) {
+	client.discoResponder.lock.Lock()
+	for _, ns := range namespaces {
+		client.discoResponder.features[ns] = struct{}{}
+	}
+	client.discoResponder.lock.Unlock()
+
+	client.refreshCaps()
+}
+
+// UnregisterFeatures stops advertising namespaces previously added with RegisterFeatures.
+// Features the sdk itself handles cannot be removed.
+func (client *XmppClient) UnregisterFeatures(namespaces ...string) {
+	client.discoResponder.lock.Lock()
+	for _, ns := range namespaces {
+		if client.isSdkFeature(ns) {
+			continue
+		}
+		delete(client.discoResponder.features, ns)
+	}
+	client.discoResponder.lock.Unlock()
+
+	client.refreshCaps()
+}
+
+// RegisterDiscoNode makes the responder answer disco#info and disco#items queries for node.
+// Registering a node that already exists replaces it.
+func (client *XmppClient) RegisterDiscoNode(node string, discoNode DiscoNode) error {
+	if node == "" {
+		return fmt.Errorf("cannot register the root node")
+	}
+	client.discoResponder.lock.Lock()
+	defer client.discoResponder.lock.Unlock()
+	client.discoResponder.nodes[node] = discoNode
+	return nil
+}
+
+// UnregisterDiscoNode removes a node previously added with RegisterDiscoNode.
+func (client *XmppClient) UnregisterDiscoNode(node string) {
+	client.discoResponder.lock.Lock()
+	defer client.discoResponder.lock.Unlock()
+	delete(client.discoResponder.nodes, node)
+}
+
+// isSdkFeature reports whether ns is one of the features the sdk always handles
+func (client *XmppClient) isSdkFeature(ns string) bool {
+	_, ok := client.discoResponder.sdk[ns]
+	return ok
+}
+
+// clientName returns the name used in our client identity
+func (client *XmppClient) clientName() string {
+	if client.Login.ClientName == "" {
+		return defaultClientName
+	}
+	return client.Login.ClientName
+}
+
+// ourInfo builds the disco#info we advertise about ourselves.
+func (client *XmppClient) ourInfo() disco.Info {
+	client.discoResponder.lock.RLock()
+	features := make([]info.Feature, 0, len(client.discoResponder.features))
+	for ns := range client.discoResponder.features {
+		features = append(features, info.Feature{Var: ns})
+	}
+	client.discoResponder.lock.RUnlock()
+
+	//keep the output stable between queries
+	sort.Slice(features, func(i, j int) bool {
+		return features[i].Var < features[j].Var
+	})
+
+	return disco.Info{
+		Identity: []info.Identity{{
+			Category: "client",
+			Type:     "pc",
+			Name:     client.clientName(),
+		}},
+		Features: features,
+	}
+}
+
+// internalHandleDiscoInfo answers disco#info queries about ourselves, including the caps nodes we advertise.
+func (client *XmppClient) internalHandleDiscoInfo(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	node := discoQueryNode(start)
+
+	var result disco.Info
+	switch node {
+	case "", capsNode + "#" + client.capsVer(), NSECaps2 + "#sha-256." + client.ecaps2Ver():
+		result = client.ourInfo()
+	default:
+		client.discoResponder.lock.RLock()
+		discoNode, ok := client.discoResponder.nodes[node]
+		client.discoResponder.lock.RUnlock()
+		if !ok {
+			return discoItemNotFound(iq, t)
+		}
+
+		result.Identity = discoNode.Identities
+		for _, ns := range discoNode.Features {
+			result.Features = append(result.Features, info.Feature{Var: ns})
+		}
+	}
+
+	//echo the node back as per https://xmpp.org/extensions/xep-0115.html#discover
+	result.Node = node
+	_, err := xmlstream.Copy(t, iq.Result(result.TokenReader()))
+	return err
+}
+
+// internalHandleDiscoItems answers disco#items queries about ourselves and our registered nodes.
+func (client *XmppClient) internalHandleDiscoItems(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	node := discoQueryNode(start)
+
+	var list []items.Item
+	client.discoResponder.lock.RLock()
+	if node == "" {
+		//root lists every registered node, on our own full jid
+		for name, discoNode := range client.discoResponder.nodes {
+			list = append(list, items.Item{
+				JID:  client.Session.LocalAddr(),
+				Node: name,
+				Name: discoNode.Name,
+			})
+		}
+	} else {
+		discoNode, ok := client.discoResponder.nodes[node]
+		if !ok {
+			client.discoResponder.lock.RUnlock()
+			return discoItemNotFound(iq, t)
+		}
+		list = discoNode.Items
+	}
+	client.discoResponder.lock.RUnlock()
+
+	payloads := make([]xml.TokenReader, 0, len(list))
+	for _, item := range list {
+		payloads = append(payloads, item.TokenReader())
+	}
+
+	query := xml.StartElement{Name: discoItemsNS}
+	if node != "" {
+		query.Attr = append(query.Attr, xml.Attr{Name: xml.Name{Local: "node"}, Value: node})
+	}
+	_, err := xmlstream.Copy(t, iq.Result(xmlstream.Wrap(xmlstream.MultiReader(payloads...), query)))
+	return err
+}
+
+// discoQueryNode pulls the node attribute out of a disco query
+func discoQueryNode(start *xml.StartElement) string {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "node" {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// discoItemNotFound responds to a disco query about a node we don't have
+func discoItemNotFound(iq stanza.IQ, t xmlstream.TokenReadEncoder) error {
+	_, err := xmlstream.Copy(t, iq.Error(stanza.Error{
+		Type:      stanza.Cancel,
+		Condition: stanza.ItemNotFound,
+	}))
+	return err
+}
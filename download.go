@@ -0,0 +1,104 @@
+package oasis_sdk
+
+// download.go downloads shared files, plain ones over HTTP and encrypted ones as per
+// https://xmpp.org/extensions/xep-0454.html
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// DownloadProgress represents the current status of a download, like UploadProgress does for uploads
+type DownloadProgress struct {
+	BytesReceived int
+	TotalBytes    int     // 0 if the server didn't say
+	Percentage    float32 // 0 if the size is unknown
+}
+
+// DownloadOptions are the optional settings of a download
+type DownloadOptions struct {
+	HTTPClient *http.Client           // client for the GET request. Defaults to http.DefaultClient
+	Progress   func(DownloadProgress) // called as the file is received, from the goroutine running Download
+}
+
+// Download fetches the file at rawURL and writes it to w. Both https:// and aesgcm:// URLs are accepted,
+// encrypted files are decrypted while they are streamed. If an encrypted file fails to decrypt,
+// ErrDecryptionFailed is returned and everything written to w must be discarded.
+func (client *XmppClient) Download(ctx context.Context, rawURL string, w io.Writer, opts DownloadOptions) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+
+	var iv, key []byte
+	getURL := u.String()
+	switch u.Scheme {
+	case schemeAesgcm:
+		getURL, iv, key, err = parseAesgcmURL(u)
+		if err != nil {
+			return err
+		}
+	case "https", "http":
+	default:
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create download request: %w", err)
+	}
+
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed with status code: %d", resp.StatusCode)
+	}
+
+	//progress counts the bytes coming over the wire
+	total := max(resp.ContentLength, 0)
+	var body io.Reader = &progressReader{
+		reader:    resp.Body,
+		totalSize: int(total),
+		progressFunc: func(bytesReceived int) {
+			if opts.Progress == nil {
+				return
+			}
+			progress := DownloadProgress{
+				BytesReceived: bytesReceived,
+				TotalBytes:    int(total),
+			}
+			if total > 0 {
+				progress.Percentage = float32(bytesReceived) / float32(total) * 100
+			}
+			opts.Progress(progress)
+		},
+	}
+
+	if key != nil {
+		body, err = newGCMDecryptReader(body, key, iv)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.Copy(w, body)
+	if errors.Is(err, ErrDecryptionFailed) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,489 @@
+package oasis_sdk
+
+// fileSharing.go implements sharing files in messages as per https://xmpp.org/extensions/xep-0447.html
+// with file metadata as per https://xmpp.org/extensions/xep-0446.html, and reads files shared as per
+// https://xmpp.org/extensions/xep-0385.html and https://xmpp.org/extensions/xep-0066.html#x-oob
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	nsSFS          = "urn:xmpp:sfs:0"
+	hashAlgoSHA256 = "sha-256"
+)
+
+// ------ mellium routing namespaces -------
+var fileSourcesNS = xml.Name{
+	Space: nsSFS,
+	Local: "sources",
+}
+var fileSharingNS = xml.Name{
+	Space: nsSFS,
+	Local: "file-sharing",
+}
+
+// Attachment is a file shared in a message, whichever way it was shared
+type Attachment struct {
+	ID          string            // identifies the file when sources are attached later, SFS only
+	Sources     []string          // URLs the file can be downloaded from
+	Name        string            // file name, may be empty
+	MediaType   string            // MIME type, may be empty
+	Size        int64             // size in bytes, 0 if unknown
+	Hashes      map[string][]byte // hashes of the file by algorithm as per https://xmpp.org/extensions/xep-0300.html, such as "sha-256"
+	Width       int               // images and video, 0 if unknown
+	Height      int               // images and video, 0 if unknown
+	Duration    time.Duration     // audio and video, 0 if unknown
+	Description string
+	Disposition string      // "inline" or "attachment", how the sender would like the file shown
+	Thumbnails  []Thumbnail // small previews to show until the file is downloaded
+	Blurhash    string      // blurred placeholder of images as per https://github.com/woltapp/blurhash, empty if none
+}
+
+// AttachmentFromUpload describes an uploaded file as an attachment to send with SendAttachments.
+func AttachmentFromUpload(res *UploadResult, description string) Attachment {
+	attachment := Attachment{
+		Sources:     []string{res.GetURL},
+		Name:        res.Name,
+		MediaType:   res.ContentType,
+		Size:        res.Size,
+		Width:       res.Width,
+		Height:      res.Height,
+		Duration:    res.Duration,
+		Description: description,
+	}
+	if res.SHA256 != nil {
+		attachment.Hashes = map[string][]byte{hashAlgoSHA256: res.SHA256}
+	}
+	if res.Thumbnail != nil {
+		attachment.Thumbnails = []Thumbnail{*res.Thumbnail}
+	}
+	attachment.Blurhash = res.Blurhash
+	return attachment
+}
+
+// FileHash is a hash of a file as per https://xmpp.org/extensions/xep-0300.html
+type FileHash struct {
+	XMLName xml.Name `xml:"urn:xmpp:hashes:2 hash"`
+	Algo    string   `xml:"algo,attr"`
+	Value   string   `xml:",chardata"` //base64
+}
+
+// FileMetadata describes a file as per https://xmpp.org/extensions/xep-0446.html
+type FileMetadata struct {
+	XMLName    xml.Name    `xml:"urn:xmpp:file:metadata:0 file"`
+	MediaType  string      `xml:"media-type,omitempty"`
+	Name       string      `xml:"name,omitempty"`
+	Size       int64       `xml:"size,omitempty"`
+	Desc       string      `xml:"desc,omitempty"`
+	Hashes     []FileHash  `xml:"urn:xmpp:hashes:2 hash"`
+	Width      int         `xml:"width,omitempty"`
+	Height     int         `xml:"height,omitempty"`
+	Length     int64       `xml:"length,omitempty"` //milliseconds
+	Thumbnails []Thumbnail `xml:"urn:xmpp:thumbs:1 thumbnail"`
+}
+
+// URLData is an HTTP source of a file as per https://xmpp.org/extensions/xep-0103.html
+type URLData struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/url-data url-data"`
+	Target  string   `xml:"target,attr"`
+}
+
+// FileSources lists where a shared file can be downloaded from
+type FileSources struct {
+	XMLName xml.Name  `xml:"urn:xmpp:sfs:0 sources"`
+	ID      string    `xml:"id,attr,omitempty"` //set when attached to an earlier message
+	URLData []URLData `xml:"http://jabber.org/protocol/url-data url-data"`
+}
+
+// FileSharing shares a single file as per https://xmpp.org/extensions/xep-0447.html
+type FileSharing struct {
+	XMLName     xml.Name     `xml:"urn:xmpp:sfs:0 file-sharing"`
+	ID          string       `xml:"id,attr,omitempty"`
+	Disposition string       `xml:"disposition,attr,omitempty"`
+	File        FileMetadata `xml:"urn:xmpp:file:metadata:0 file"`
+	Sources     FileSources  `xml:"urn:xmpp:sfs:0 sources"`
+}
+
+// AttachTo points at the message something is attached to as per https://xmpp.org/extensions/xep-0367.html
+type AttachTo struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-attaching:1 attach-to"`
+	ID      string   `xml:"id,attr"`
+}
+
+// simsFile is the file description of SIMS, borrowed from jingle file transfer
+type simsFile struct {
+	MediaType  string      `xml:"media-type"`
+	Name       string      `xml:"name"`
+	Size       int64       `xml:"size"`
+	Desc       string      `xml:"desc"`
+	Hashes     []FileHash  `xml:"urn:xmpp:hashes:2 hash"`
+	Thumbnails []Thumbnail `xml:"urn:xmpp:thumbs:1 thumbnail"`
+}
+
+// Reference is a reference as per https://xmpp.org/extensions/xep-0372.html, only read for the files
+// it shares as per https://xmpp.org/extensions/xep-0385.html
+type Reference struct {
+	XMLName      xml.Name `xml:"urn:xmpp:reference:0 reference"`
+	Type         string   `xml:"type,attr"`
+	URI          string   `xml:"uri,attr,omitempty"`
+	MediaSharing *struct {
+		Files   []simsFile `xml:"file"`
+		Sources []struct {
+			URI string `xml:"uri,attr"`
+		} `xml:"sources>reference"`
+	} `xml:"urn:xmpp:sims:1 media-sharing"`
+}
+
+// SendAttachments sends files in a single message as per https://xmpp.org/extensions/xep-0447.html.
+// The body holds their URLs for clients that don't support it, and a single file is also sent as per
+// https://xmpp.org/extensions/xep-0066.html#x-oob so those clients show it inline.
+// Attachments without an ID are given one, which is written back into attachments, so sources can be
+// attached to them later with SendFileSources.
+func (client *XmppClient) SendAttachments(to jid.JID, attachments ...Attachment) error {
+	//determine if we're sending to a group chat, or privately to one of its occupants
+	msgType, mucUser := client.messageTypeFor(to)
+
+	sharing := make([]FileSharing, 0, len(attachments))
+	urls := make([]string, 0, len(attachments))
+	for i := range attachments {
+		if attachments[i].ID == "" {
+			attachments[i].ID = randomID()
+		}
+		attachment := attachments[i]
+		sharing = append(sharing, attachment.fileSharing())
+		if len(attachment.Sources) > 0 {
+			urls = append(urls, attachment.Sources[0])
+		}
+	}
+
+	body := strings.Join(urls, "\n")
+	msg := XMPPChatMessage{
+		Message: stanza.Message{
+			To:   to,
+			Type: msgType,
+		},
+		ChatMessageBody: ChatMessageBody{
+			Body:        &body,
+			FileSharing: sharing,
+			MUCUser:     mucUser,
+		},
+	}
+
+	// <fallback> as per https://xmpp.org/extensions/xep-0447.html#fallback
+	if body != "" {
+		msg.Fallback = []Fallback{{
+			For: nsSFS,
+			//ranges count code points as per https://xmpp.org/extensions/xep-0428.html
+			Body: FallbackBody{Start: 0, End: utf8.RuneCountInString(body)},
+		}}
+	}
+	if len(attachments) == 1 && len(urls) == 1 {
+		oob := OutOfBandMedia{URL: urls[0]}
+		if attachments[0].Description != "" {
+			oob.Description = &attachments[0].Description
+		}
+		msg.OutOfBandMedia = &oob
+	}
+
+	return client.Session.Encode(client.Ctx, msg)
+}
+
+// SendFileSources attaches more sources to a file shared earlier, as per
+// https://xmpp.org/extensions/xep-0447.html#attaching-sources. messageID is the ID of the message that shared
+// the file, which in group chats is the one the room assigned as per https://xmpp.org/extensions/xep-0367.html,
+// and fileID is the ID of the attachment in it.
+func (client *XmppClient) SendFileSources(to jid.JID, messageID string, fileID string, sources ...string) error {
+	//determine if we're sending to a group chat, or privately to one of its occupants
+	msgType, mucUser := client.messageTypeFor(to)
+
+	fileSources := FileSources{ID: fileID}
+	for _, source := range sources {
+		fileSources.URLData = append(fileSources.URLData, URLData{Target: source})
+	}
+	msg := XMPPChatMessage{
+		Message: stanza.Message{
+			To:   to,
+			Type: msgType,
+		},
+		ChatMessageBody: ChatMessageBody{
+			FileSources: []FileSources{fileSources},
+			AttachTo:    &AttachTo{ID: messageID},
+			MUCUser:     mucUser,
+		},
+	}
+	return client.Session.Encode(client.Ctx, msg)
+}
+
+// fileSharing converts the attachment to its https://xmpp.org/extensions/xep-0447.html element
+func (attachment Attachment) fileSharing() FileSharing {
+	sharing := FileSharing{
+		ID:          attachment.ID,
+		Disposition: attachment.Disposition,
+		File: FileMetadata{
+			MediaType: attachment.MediaType,
+			Name:      attachment.Name,
+			Size:      attachment.Size,
+			Desc:      attachment.Description,
+			Width:     attachment.Width,
+			Height:    attachment.Height,
+			Length:    attachment.Duration.Milliseconds(),
+		},
+	}
+	for algo, sum := range attachment.Hashes {
+		sharing.File.Hashes = append(sharing.File.Hashes, FileHash{
+			Algo:  algo,
+			Value: base64.StdEncoding.EncodeToString(sum),
+		})
+	}
+	sharing.File.Thumbnails = append(sharing.File.Thumbnails, attachment.Thumbnails...)
+	if attachment.Blurhash != "" {
+		sharing.File.Thumbnails = append(sharing.File.Thumbnails, blurhashThumbnail(attachment.Blurhash, attachment.Width, attachment.Height))
+	}
+	for _, source := range attachment.Sources {
+		sharing.Sources.URLData = append(sharing.Sources.URLData, URLData{Target: source})
+	}
+	return sharing
+}
+
+// ParseAttachments collects the files shared in the message into Attachments, and takes the file
+// URLs marked as fallback out of CleanedBody. Must be called after ParseReply.
+func (chatMsg *ChatMessageBody) ParseAttachments() {
+	chatMsg.Attachments = nil
+	seen := make(map[string]bool)
+
+	for _, sharing := range chatMsg.FileSharing {
+		attachment := Attachment{
+			ID:          sharing.ID,
+			Name:        sharing.File.Name,
+			MediaType:   sharing.File.MediaType,
+			Size:        sharing.File.Size,
+			Hashes:      decodeHashes(sharing.File.Hashes),
+			Width:       sharing.File.Width,
+			Height:      sharing.File.Height,
+			Duration:    time.Duration(sharing.File.Length) * time.Millisecond,
+			Description: sharing.File.Desc,
+			Disposition: sharing.Disposition,
+		}
+		attachment.Thumbnails, attachment.Blurhash = splitThumbnails(sharing.File.Thumbnails)
+		for _, source := range sharing.Sources.URLData {
+			attachment.Sources = append(attachment.Sources, source.Target)
+			seen[source.Target] = true
+		}
+		chatMsg.Attachments = append(chatMsg.Attachments, attachment)
+	}
+
+	//sources attached to a file of an earlier message, which the app matches up by ID
+	for _, sources := range chatMsg.FileSources {
+		attachment := Attachment{ID: sources.ID}
+		for _, source := range sources.URLData {
+			attachment.Sources = append(attachment.Sources, source.Target)
+		}
+		chatMsg.Attachments = append(chatMsg.Attachments, attachment)
+	}
+
+	for _, reference := range chatMsg.References {
+		if reference.MediaSharing == nil {
+			continue
+		}
+		var sources []string
+		for _, source := range reference.MediaSharing.Sources {
+			if source.URI == "" || seen[source.URI] {
+				continue
+			}
+			sources = append(sources, source.URI)
+			seen[source.URI] = true
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		attachment := Attachment{Sources: sources}
+		if len(reference.MediaSharing.Files) > 0 {
+			file := reference.MediaSharing.Files[0]
+			attachment.Name = file.Name
+			attachment.MediaType = file.MediaType
+			attachment.Size = file.Size
+			attachment.Hashes = decodeHashes(file.Hashes)
+			attachment.Description = file.Desc
+			attachment.Thumbnails, attachment.Blurhash = splitThumbnails(file.Thumbnails)
+		}
+		chatMsg.Attachments = append(chatMsg.Attachments, attachment)
+	}
+
+	//oob is the fallback of the others, only use it if it adds a file
+	if chatMsg.OutOfBandMedia != nil && chatMsg.OutOfBandMedia.URL != "" && !seen[chatMsg.OutOfBandMedia.URL] {
+		attachment := Attachment{
+			Sources: []string{chatMsg.OutOfBandMedia.URL},
+			Name:    nameFromURL(chatMsg.OutOfBandMedia.URL),
+		}
+		if chatMsg.OutOfBandMedia.Description != nil {
+			attachment.Description = *chatMsg.OutOfBandMedia.Description
+		}
+		chatMsg.Attachments = append(chatMsg.Attachments, attachment)
+	}
+
+	chatMsg.stripFileFallback()
+}
+
+// stripFileFallback removes the file URLs marked as fallback from CleanedBody, along with the reply fallback
+func (chatMsg *ChatMessageBody) stripFileFallback() {
+	if chatMsg.Body == nil || len(chatMsg.FileSharing) == 0 {
+		return
+	}
+	//ranges count code points, not bytes
+	body := []rune(*chatMsg.Body)
+
+	type span struct{ start, end int }
+	var spans []span
+	for _, fallback := range chatMsg.Fallback {
+		switch {
+		case fallback.For == nsSFS && fallback.Body.End == 0:
+			//no range means the whole body
+			spans = append(spans, span{0, len(body)})
+		case fallback.For == nsSFS || (fallback.For == "urn:xmpp:reply:0" && chatMsg.ReplyFallbackText != nil):
+			spans = append(spans, span{fallback.Body.Start, fallback.Body.End})
+		}
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	keep := make([]bool, len(body))
+	for i := range keep {
+		keep[i] = true
+	}
+	for _, s := range spans {
+		for i := max(s.start, 0); i < min(s.end, len(body)); i++ {
+			keep[i] = false
+		}
+	}
+	cleaned := strings.Builder{}
+	for i, c := range body {
+		if keep[i] {
+			cleaned.WriteRune(c)
+		}
+	}
+	result := strings.TrimSpace(cleaned.String())
+	chatMsg.CleanedBody = &result
+}
+
+// fileReplay remembers the body-less file message replayed last. The mux calls us once per file-sharing and
+// sources element of a message, but it must only be delivered once.
+type fileReplay struct {
+	lock sync.Mutex
+	key  string
+	skip int
+}
+
+// internalHandleFileMessage delivers file messages that carry no body: files shared without a text
+// fallback, and sources attached to a file shared earlier as per https://xmpp.org/extensions/xep-0447.html#attach-source.
+// Ones with a body already went through the body route.
+func (client *XmppClient) internalHandleFileMessage(header stanza.Message, t xmlstream.TokenReadEncoder) error {
+	raw := rawXML{}
+	err := xml.NewTokenDecoder(t).Decode(&raw)
+	if err != nil {
+		return err
+	}
+	check := struct {
+		Body        *string    `xml:"body"`
+		FileSharing []struct{} `xml:"file-sharing"`
+		Sources     []struct{} `xml:"sources"`
+	}{}
+	err = raw.Decode(&check)
+	if err != nil || check.Body != nil {
+		return err
+	}
+
+	//stanzas are dispatched one after another, so the calls for one message follow each other
+	key, err := xml.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	client.fileReplay.lock.Lock()
+	if client.fileReplay.skip > 0 && client.fileReplay.key == string(key) {
+		client.fileReplay.skip--
+		client.fileReplay.lock.Unlock()
+		return nil
+	}
+	client.fileReplay.key = string(key)
+	client.fileReplay.skip = len(check.FileSharing) + len(check.Sources) - 1
+	client.fileReplay.lock.Unlock()
+
+	//hand a replay of the message to the usual message handling
+	replay := struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: raw.TokenReader(),
+		Encoder:     t,
+	}
+	if header.Type == stanza.GroupChatMessage {
+		return client.internalHandleGroupMsg(header, replay)
+	}
+	return client.internalHandleDM(header, replay)
+}
+
+// decodeHashes converts hash elements, skipping ones that aren't valid base64
+func decodeHashes(hashes []FileHash) map[string][]byte {
+	if len(hashes) == 0 {
+		return nil
+	}
+	res := make(map[string][]byte, len(hashes))
+	for _, hash := range hashes {
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimSpace(hash.Value))
+		if err != nil {
+			continue
+		}
+		res[hash.Algo] = sum
+	}
+	return res
+}
+
+// splitThumbnails separates the blurhash from the image thumbnails
+func splitThumbnails(thumbnails []Thumbnail) ([]Thumbnail, string) {
+	var images []Thumbnail
+	hash := ""
+	for _, thumbnail := range thumbnails {
+		if thumbnail.MediaType != mediaTypeBlurhash && !strings.HasPrefix(thumbnail.URI, "data:"+mediaTypeBlurhash+",") {
+			images = append(images, thumbnail)
+			continue
+		}
+		if data, ok := thumbnail.Data(); ok && hash == "" {
+			hash = string(data)
+		}
+	}
+	return images, hash
+}
+
+// nameFromURL guesses a file name from the last segment of its URL
+func nameFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Path == "" {
+		return ""
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
+
+// randomID returns a random identifier for elements that need one
+func randomID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
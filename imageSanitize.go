@@ -0,0 +1,424 @@
+package oasis_sdk
+
+// imageSanitize.go cleans up images before they are uploaded: metadata such as the GPS coordinates phones
+// put in EXIF is removed, the EXIF orientation is applied, and images can be scaled down or re-encoded
+// to fit a size limit. JPEG and PNG are fully supported. The standard library can't decode WebP, so those
+// only have their metadata chunks removed, leaving orientation and size alone.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// sanitizeMaxSize is the largest image cleaned up, they have to be held in memory for it
+	sanitizeMaxSize = 64 << 20
+	// reencodeQuality is the JPEG quality of re-encoded images that have no size limit
+	reencodeQuality = 90
+	// how many times an image is scaled down trying to fit the size limit
+	maxFitRounds = 8
+)
+
+// ErrImageTooLarge is returned when an image can't be made to fit the size limit
+var ErrImageTooLarge = errors.New("image could not be made small enough")
+
+// ImageOptions control how images are cleaned up before they are uploaded
+type ImageOptions struct {
+	StripMetadata  bool  // remove EXIF, XMP, IPTC and comments, applying the EXIF orientation
+	MaxDimension   int   // scale down JPEG and PNG images whose longest side is larger, 0 for no limit
+	MaxBytes       int64 // re-encode JPEG and PNG images larger than this, 0 for no limit
+	FitUploadLimit bool  // also re-encode JPEG and PNG images larger than the MaxFileSize of the upload component
+}
+
+// preparedUpload is a file ready to be uploaded, possibly replaced by a cleaned up image
+type preparedUpload struct {
+	name        string
+	size        int64
+	r           io.Reader
+	contentType string
+}
+
+// prepareUpload works out the content type of a file, and cleans it up if it is an image and opts ask for it.
+// overhead is how much larger the upload gets than the file, taken off the upload size limit.
+func (client *XmppClient) prepareUpload(ctx context.Context, name string, size int64, r io.Reader, opts UploadOptions, overhead int64) (preparedUpload, error) {
+	file := preparedUpload{name: name, size: size, r: r, contentType: opts.ContentType}
+	if file.contentType == "" {
+		file.contentType, file.r = detectContentType(name, r)
+	}
+
+	imageOpts := opts.Image
+	if imageOpts == nil {
+		imageOpts = client.UploadImages
+	}
+	switch {
+	case imageOpts == nil:
+		return file, nil
+	case file.contentType != "image/jpeg" && file.contentType != "image/png" && file.contentType != "image/webp":
+		return file, nil
+	case size > sanitizeMaxSize:
+		return file, fmt.Errorf("image of %d bytes is too large to clean up", size)
+	}
+
+	budget := imageOpts.MaxBytes
+	if imageOpts.FitUploadLimit && client.AwaitDiscovery(ctx) == nil {
+		//the largest service is picked for files the others refuse
+		if maxSize := client.maxUploadSize(); maxSize > 0 {
+			limit := maxSize - overhead
+			if budget <= 0 || limit < budget {
+				budget = limit
+			}
+		}
+	}
+
+	data := make([]byte, size)
+	_, err := io.ReadFull(file.r, data)
+	if err != nil {
+		return file, fmt.Errorf("failed to read image: %w", err)
+	}
+	data, contentType, err := sanitizeImage(data, file.contentType, *imageOpts, budget)
+	if err != nil {
+		return file, err
+	}
+
+	//re-encoding may change the format, so fix the extension
+	if contentType != file.contentType {
+		file.name = strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+	}
+	file.contentType = contentType
+	file.size = int64(len(data))
+	file.r = bytes.NewReader(data)
+	return file, nil
+}
+
+// sanitizeImage cleans up an image, returning it with its possibly changed content type.
+// Images that need no decoding only have their metadata cut out, so they keep their quality.
+func sanitizeImage(data []byte, contentType string, opts ImageOptions, budget int64) ([]byte, string, error) {
+	//re-encoded images lose their EXIF, so the rotation it asks for is applied whenever we decode
+	orientation := exifOrientation(data, contentType)
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	decodable := err == nil
+
+	needsDecode := decodable && ((opts.StripMetadata && orientation > 1) ||
+		(opts.MaxDimension > 0 && max(config.Width, config.Height) > opts.MaxDimension) ||
+		(budget > 0 && int64(len(data)) > budget))
+
+	if !needsDecode {
+		if !opts.StripMetadata {
+			return data, contentType, nil
+		}
+		stripped, err := stripMetadata(data, contentType)
+		if err == nil || !decodable {
+			return stripped, contentType, err
+		}
+		//images we can't take apart are re-encoded instead
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	img = applyOrientation(img, orientation)
+	if opts.MaxDimension > 0 {
+		img = scaleDown(img, opts.MaxDimension)
+	}
+	//the encoders write no metadata, so re-encoded images are clean
+	return fitImage(img, contentType, budget)
+}
+
+// fitImage encodes img, lowering the quality and then the size until it fits budget.
+// PNGs that don't fit become JPEGs.
+func fitImage(img image.Image, contentType string, budget int64) ([]byte, string, error) {
+	buf := bytes.Buffer{}
+	fits := func() bool {
+		return budget <= 0 || int64(buf.Len()) <= budget
+	}
+
+	if contentType == "image/png" {
+		err := png.Encode(&buf, img)
+		if err != nil {
+			return nil, "", err
+		}
+		if fits() {
+			return buf.Bytes(), contentType, nil
+		}
+		img = flatten(img)
+	}
+
+	for round := 0; round < maxFitRounds; round++ {
+		for _, quality := range []int{reencodeQuality, 80, 70, 60} {
+			buf.Reset()
+			err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+			if err != nil {
+				return nil, "", err
+			}
+			if fits() {
+				return buf.Bytes(), "image/jpeg", nil
+			}
+		}
+		bounds := img.Bounds()
+		img = scaleDown(img, max(bounds.Dx(), bounds.Dy())*3/4)
+	}
+	return nil, "", ErrImageTooLarge
+}
+
+// flatten puts an image on white, for formats without transparency
+func flatten(img image.Image) image.Image {
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+	return flat
+}
+
+// applyOrientation turns img upright as per its EXIF orientation, 1 through 8
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	//orientations 5 to 8 swap the sides
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+// exifOrientation finds the orientation in the EXIF of a JPEG or PNG, 1 if it has none
+func exifOrientation(data []byte, contentType string) int {
+	var tiff []byte
+	switch contentType {
+	case "image/jpeg":
+		_, _ = walkJPEG(data, func(marker byte, segment []byte) bool {
+			if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				tiff = segment[6:]
+				return false
+			}
+			return true
+		})
+	case "image/png":
+		_ = walkPNG(data, func(kind string, chunk []byte) bool {
+			if kind == "eXIf" {
+				tiff = chunk
+				return false
+			}
+			return true
+		})
+	}
+	return tiffOrientation(tiff)
+}
+
+// tiffOrientation reads the orientation tag from the first directory of TIFF formatted EXIF
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		//orientation is a single SHORT
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
+
+// stripMetadata cuts the metadata out of an image without decoding it
+func stripMetadata(data []byte, contentType string) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	case "image/webp":
+		return stripWebP(data)
+	}
+	return data, nil
+}
+
+// walkJPEG calls fn with the marker and payload of every segment before the image data, until it returns false.
+// Returns where the image data starts.
+func walkJPEG(data []byte, fn func(marker byte, segment []byte) bool) (int, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return 0, errors.New("not a JPEG image")
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 0, errors.New("malformed JPEG image")
+		}
+		marker := data[i+1]
+		//start of scan, the image data follows
+		if marker == 0xda {
+			return i, nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 0, errors.New("malformed JPEG image")
+		}
+		if !fn(marker, data[i+4:i+2+length]) {
+			return i, nil
+		}
+		i += 2 + length
+	}
+	return 0, errors.New("truncated JPEG image")
+}
+
+// stripJPEG drops the EXIF and XMP (APP1), IPTC (APP13), other application segments and comments,
+// keeping JFIF (APP0), the color profile (APP2) and Adobe color information (APP14).
+// Anything after the end of the image, where some phones hide extra data, is dropped too.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := bytes.Buffer{}
+	out.Grow(len(data))
+	out.Write(data[:2])
+
+	scan, err := walkJPEG(data, func(marker byte, segment []byte) bool {
+		isApp := marker >= 0xe0 && marker <= 0xef
+		if (isApp || marker == 0xfe) && marker != 0xe0 && marker != 0xe2 && marker != 0xee {
+			return true
+		}
+		out.Write([]byte{0xff, marker})
+		_ = binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+		out.Write(segment)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//copy the scans up to the end of image marker, markers in the data are escaped so can't be mistaken for it
+	for j := scan; j+1 < len(data); j++ {
+		if data[j] == 0xff && data[j+1] == 0xd9 {
+			out.Write(data[scan : j+2])
+			return out.Bytes(), nil
+		}
+	}
+	out.Write(data[scan:])
+	return out.Bytes(), nil
+}
+
+// walkPNG calls fn with the type and data of every chunk, until it returns false
+func walkPNG(data []byte, fn func(kind string, chunk []byte) bool) error {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return errors.New("not a PNG image")
+	}
+	for i := 8; i+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if length < 0 || i+12+length > len(data) {
+			return errors.New("malformed PNG image")
+		}
+		if !fn(string(data[i+4:i+8]), data[i+8:i+8+length]) {
+			return nil
+		}
+		i += 12 + length
+	}
+	return nil
+}
+
+// stripPNG drops the EXIF (eXIf), text chunks, where XMP lives too, and the modification time
+func stripPNG(data []byte) ([]byte, error) {
+	out := bytes.Buffer{}
+	out.Grow(len(data))
+	out.Write(data[:min(8, len(data))])
+	i := 8
+	err := walkPNG(data, func(kind string, chunk []byte) bool {
+		size := 12 + len(chunk)
+		switch kind {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out.Write(data[i : i+size])
+		}
+		i += size
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// stripWebP drops the EXIF and XMP chunks, and clears their flags in the extended header
+func stripWebP(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP image")
+	}
+	out := bytes.Buffer{}
+	out.Grow(len(data))
+	out.Write(data[:12])
+	for i := 12; i+8 <= len(data); {
+		kind := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		//chunks are padded to an even size
+		end := i + 8 + size + size&1
+		if size < 0 || end > len(data) {
+			end = len(data)
+		}
+		switch kind {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			start := out.Len()
+			out.Write(data[i:end])
+			//truncated chunks may not even hold the flags
+			if end-i > 8 {
+				out.Bytes()[start+8] &^= 0x08 | 0x04
+			}
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+	res := out.Bytes()
+	binary.LittleEndian.PutUint32(res[4:], uint32(len(res)-8))
+	return res, nil
+}
@@ -0,0 +1,347 @@
+package oasis_sdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"slices"
+	"testing"
+)
+
+// exifTIFF builds TIFF formatted EXIF holding only the orientation tag
+func exifTIFF(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	return tiff
+}
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 16), G: uint8(y * 32), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func jpegSegment(marker byte, payload string) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func pngChunk(kind string, data string) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func webpChunk(kind string, data string) []byte {
+	chunk := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func webpFile(chunks ...[]byte) []byte {
+	body := slices.Concat(chunks...)
+	file := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)+4))...)
+	file = append(file, "WEBP"...)
+	return append(file, body...)
+}
+
+func TestStripJPEG(t *testing.T) {
+	encoded := bytes.Buffer{}
+	err := jpeg.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := encoded.Bytes()
+
+	tests := map[string]struct {
+		segments [][]byte
+		drop     []string
+		keep     []string
+	}{
+		"exif": {
+			segments: [][]byte{jpegSegment(0xe1, "Exif\x00\x00"+string(exifTIFF(binary.BigEndian, 6)))},
+			drop:     []string{"Exif"},
+		},
+		"xmp": {
+			segments: [][]byte{jpegSegment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPS</x:xmpmeta>")},
+			drop:     []string{"xap/1.0", "xmpmeta"},
+		},
+		"iptc": {
+			segments: [][]byte{jpegSegment(0xed, "Photoshop 3.0\x008BIM\x04\x04")},
+			drop:     []string{"Photoshop", "8BIM"},
+		},
+		"comment": {
+			segments: [][]byte{jpegSegment(0xfe, "secret comment")},
+			drop:     []string{"secret"},
+		},
+		"color profile": {
+			segments: [][]byte{jpegSegment(0xe2, "ICC_PROFILE\x00\x01\x01profile")},
+			keep:     []string{"ICC_PROFILE"},
+		},
+		"everything": {
+			segments: [][]byte{
+				jpegSegment(0xe1, "Exif\x00\x00"+string(exifTIFF(binary.LittleEndian, 3))),
+				jpegSegment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"),
+				jpegSegment(0xe2, "ICC_PROFILE\x00\x01\x01profile"),
+				jpegSegment(0xed, "Photoshop 3.0\x008BIM"),
+			},
+			drop: []string{"Exif", "xap/1.0", "Photoshop"},
+			keep: []string{"ICC_PROFILE"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			//the segments go right after the start of image, and data some phones hide after the end of it
+			data := slices.Concat(plain[:2], slices.Concat(test.segments...), plain[2:], []byte("trailing data"))
+			out, err := stripJPEG(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range append(test.drop, "trailing data") {
+				if bytes.Contains(out, []byte(s)) {
+					t.Errorf("%q was not removed", s)
+				}
+			}
+			for _, s := range test.keep {
+				if !bytes.Contains(out, []byte(s)) {
+					t.Errorf("%q was removed", s)
+				}
+			}
+			if got := exifOrientation(out, "image/jpeg"); got != 1 {
+				t.Errorf("orientation %d left in the output", got)
+			}
+			img, err := jpeg.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("output doesn't decode: %v", err)
+			}
+			if img.Bounds() != testImage().Bounds() {
+				t.Errorf("decoded to %v, want %v", img.Bounds(), testImage().Bounds())
+			}
+		})
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	encoded := bytes.Buffer{}
+	err := png.Encode(&encoded, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := encoded.Bytes()
+	//signature and IHDR, metadata chunks go after it
+	header := 8 + 12 + 13
+
+	chunks := slices.Concat(
+		pngChunk("eXIf", string(exifTIFF(binary.BigEndian, 8))),
+		pngChunk("tEXt", "Comment\x00secret comment"),
+		pngChunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta>GPS</x:xmpmeta>"),
+		pngChunk("zTXt", "Author\x00\x00compressed"),
+		pngChunk("tIME", "\x07\xea\x0a\x13\x0c\x00\x00"),
+		pngChunk("gAMA", "\x00\x00\xb1\x8f"),
+	)
+	data := slices.Concat(plain[:header], chunks, plain[header:])
+	if got := exifOrientation(data, "image/png"); got != 8 {
+		t.Fatalf("test image has orientation %d, want 8", got)
+	}
+
+	out, err := stripPNG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	err = walkPNG(out, func(kind string, chunk []byte) bool {
+		kinds = append(kinds, kind)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{"eXIf", "tEXt", "iTXt", "zTXt", "tIME"} {
+		if slices.Contains(kinds, kind) {
+			t.Errorf("%s chunk was not removed", kind)
+		}
+	}
+	if !slices.Contains(kinds, "gAMA") {
+		t.Error("gAMA chunk was removed")
+	}
+	for _, s := range []string{"secret", "xmpmeta"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q was not removed", s)
+		}
+	}
+	img, err := png.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("output doesn't decode: %v", err)
+	}
+	if img.Bounds() != testImage().Bounds() {
+		t.Errorf("decoded to %v, want %v", img.Bounds(), testImage().Bounds())
+	}
+}
+
+func TestStripWebP(t *testing.T) {
+	//VP8X with alpha, EXIF and XMP flags, on a 16x8 canvas
+	vp8x := "\x1c\x00\x00\x00\x0f\x00\x00\x07\x00\x00"
+	frame := "frame data" + "!" //odd sized, so it is padded
+	tests := map[string]struct {
+		data  []byte
+		kinds []string
+		flags byte
+	}{
+		"extended": {
+			data: webpFile(
+				webpChunk("VP8X", vp8x),
+				webpChunk("VP8 ", frame),
+				webpChunk("EXIF", "Exif\x00\x00"+string(exifTIFF(binary.LittleEndian, 6))),
+				webpChunk("XMP ", "<x:xmpmeta>GPS</x:xmpmeta>!"),
+			),
+			kinds: []string{"VP8X", "VP8 "},
+			flags: 0x10,
+		},
+		"metadata first": {
+			data: webpFile(
+				webpChunk("VP8X", vp8x),
+				webpChunk("XMP ", "<x:xmpmeta/>"),
+				webpChunk("ALPH", "alpha"),
+				webpChunk("VP8L", frame),
+				webpChunk("EXIF", "Exif"),
+			),
+			kinds: []string{"VP8X", "ALPH", "VP8L"},
+			flags: 0x10,
+		},
+		"simple": {
+			data:  webpFile(webpChunk("VP8 ", frame)),
+			kinds: []string{"VP8 "},
+		},
+		"truncated header": {
+			data:  webpFile([]byte("VP8X\x00\x00\x00\x00")),
+			kinds: []string{"VP8X"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			out, err := stripWebP(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+				t.Errorf("RIFF size is %d, want %d", size, len(out)-8)
+			}
+
+			var kinds []string
+			for i := 12; i < len(out); {
+				if i+8 > len(out) {
+					t.Fatalf("chunk header at %d cut off", i)
+				}
+				kind := string(out[i : i+4])
+				size := int(binary.LittleEndian.Uint32(out[i+4:]))
+				end := i + 8 + size + size&1
+				if end > len(out) {
+					t.Fatalf("%s chunk at %d overruns the file", kind, i)
+				}
+				switch kind {
+				case "VP8X":
+					if size >= 1 && out[i+8] != test.flags {
+						t.Errorf("VP8X flags are %#x, want %#x", out[i+8], test.flags)
+					}
+				case "VP8 ", "VP8L":
+					if got := string(out[i+8 : i+8+size]); got != frame {
+						t.Errorf("frame changed to %q", got)
+					}
+				}
+				kinds = append(kinds, kind)
+				i = end
+			}
+			if !slices.Equal(kinds, test.kinds) {
+				t.Errorf("chunks are %q, want %q", kinds, test.kinds)
+			}
+			if bytes.Contains(out, []byte("xmpmeta")) || bytes.Contains(out, []byte("Exif")) {
+				t.Error("metadata was not removed")
+			}
+		})
+	}
+}
+
+func TestTiffOrientation(t *testing.T) {
+	tests := map[string]struct {
+		tiff []byte
+		want int
+	}{
+		"little endian": {exifTIFF(binary.LittleEndian, 6), 6},
+		"big endian":    {exifTIFF(binary.BigEndian, 8), 8},
+		"none":          {nil, 1},
+		"bad order":     {append([]byte("XX"), exifTIFF(binary.BigEndian, 3)[2:]...), 1},
+		"truncated":     {exifTIFF(binary.BigEndian, 3)[:16], 1},
+		"bad offset":    {append(exifTIFF(binary.BigEndian, 3)[:4], 0xff, 0xff, 0xff, 0xff), 1},
+	}
+	for name, test := range tests {
+		if got := tiffOrientation(test.tiff); got != test.want {
+			t.Errorf("%s: got %d, want %d", name, got, test.want)
+		}
+	}
+}
+
+// grid makes an image from rows of letters, each letter a shade of gray
+func grid(rows ...string) image.Image {
+	img := image.NewGray(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, c := range []byte(row) {
+			img.SetGray(x, y, color.Gray{Y: c})
+		}
+	}
+	return img
+}
+
+func TestApplyOrientation(t *testing.T) {
+	upright := grid("abc", "def")
+	//how a camera stores the upright image with each orientation
+	stored := map[int]image.Image{
+		1: grid("abc", "def"),
+		2: grid("cba", "fed"),
+		3: grid("fed", "cba"),
+		4: grid("def", "abc"),
+		5: grid("ad", "be", "cf"),
+		6: grid("cf", "be", "ad"),
+		7: grid("fc", "eb", "da"),
+		8: grid("da", "eb", "fc"),
+	}
+	for orientation := 1; orientation <= 8; orientation++ {
+		got := applyOrientation(stored[orientation], orientation)
+		if got.Bounds().Size() != upright.Bounds().Size() {
+			t.Errorf("orientation %d: size %v, want %v", orientation, got.Bounds().Size(), upright.Bounds().Size())
+			continue
+		}
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 3; x++ {
+				want := upright.At(x, y).(color.Gray)
+				have := color.GrayModel.Convert(got.At(got.Bounds().Min.X+x, got.Bounds().Min.Y+y)).(color.Gray)
+				if have != want {
+					t.Errorf("orientation %d: pixel %d,%d is %q, want %q", orientation, x, y, have.Y, want.Y)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package oasis_sdk
+
+// invites.go implements room invitations, both mediated through the room as per
+// https://xmpp.org/extensions/xep-0045.html#invite and direct as per https://xmpp.org/extensions/xep-0249.html
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/muc"
+	"mellium.im/xmpp/stanza"
+)
+
+// ------ mellium routing namespaces -------
+var directInviteNS = xml.Name{
+	Space: muc.NSConf,
+	Local: "x",
+}
+
+// RoomInvitation is an invitation to join a room, received either way
+type RoomInvitation struct {
+	Room     jid.JID
+	From     jid.JID // who invited us, may be empty for mediated invitations from anonymous rooms
+	Reason   string
+	Password string
+	Continue bool   // the invitation continues a one to one chat in the room
+	Thread   string // optional thread of the chat being continued
+	Direct   bool   // sent directly by the inviter rather than through the room
+}
+
+type mucUserInvite struct {
+	From     string `xml:"from,attr"`
+	Reason   string `xml:"reason"`
+	Continue *struct {
+		Thread string `xml:"thread,attr"`
+	} `xml:"continue"`
+}
+
+type mucUserDecline struct {
+	From   string `xml:"from,attr"`
+	Reason string `xml:"reason"`
+}
+
+// mucUserMessage is a message from a room carrying a mediated invitation or decline
+type mucUserMessage struct {
+	stanza.Message
+	X struct {
+		Invite   *mucUserInvite  `xml:"invite"`
+		Decline  *mucUserDecline `xml:"decline"`
+		Password string          `xml:"password"`
+	} `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+type directInviteMessage struct {
+	stanza.Message
+	Invite muc.Invitation `xml:"jabber:x:conference x"`
+}
+
+// SetInvitationHandler sets the handler function called when we are invited to a room.
+func (client *XmppClient) SetInvitationHandler(handler InvitationHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.InvitationHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// InviteToRoom invites someone to a room we are in. The invitation is sent directly when the invitee
+// advertises support for it, since that also reaches people who only accept messages from contacts,
+// and through the room otherwise.
+func (client *XmppClient) InviteToRoom(ctx context.Context, room jid.JID, invitee jid.JID, reason string) error {
+	room = room.Bare()
+
+	if client.supportsFeatureAnyResource(invitee, muc.NSConf) {
+		invite := muc.Invitation{
+			JID:    room,
+			Reason: reason,
+		}
+		//direct invitations skip the room, so they need to carry the password themselves
+		client.bookmarkLock.RLock()
+		if bookmark, ok := client.bookmarks[room.String()]; ok {
+			invite.Password = bookmark.Password
+		}
+		client.bookmarkLock.RUnlock()
+
+		err := muc.Invite(ctx, invitee, invite, client.Session)
+		if err != nil {
+			return fmt.Errorf("unable to invite %s to %s: %w", invitee.String(), room.String(), err)
+		}
+		return nil
+	}
+
+	invite := muc.Invitation{
+		JID:    invitee,
+		Reason: reason,
+	}
+	err := client.Session.Send(ctx, stanza.Message{
+		To:   room,
+		Type: stanza.NormalMessage,
+	}.Wrap(invite.MarshalMediated()))
+	if err != nil {
+		return fmt.Errorf("unable to invite %s to %s: %w", invitee.String(), room.String(), err)
+	}
+	return nil
+}
+
+// DeclineInvitation tells the inviter we won't join. Only mediated invitations can be declined,
+// direct ones are simply ignored.
+func (client *XmppClient) DeclineInvitation(ctx context.Context, invite RoomInvitation, reason string) error {
+	if invite.Direct {
+		return errors.New("direct invitations cannot be declined")
+	}
+
+	var reasonEl xml.TokenReader
+	if reason != "" {
+		reasonEl = xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(reason)),
+			xml.StartElement{Name: xml.Name{Local: "reason"}},
+		)
+	}
+	var attr []xml.Attr
+	if !invite.From.Equal(jid.JID{}) {
+		attr = append(attr, xml.Attr{Name: xml.Name{Local: "to"}, Value: invite.From.String()})
+	}
+	payload := xmlstream.Wrap(
+		xmlstream.Wrap(reasonEl, xml.StartElement{Name: xml.Name{Local: "decline"}, Attr: attr}),
+		xml.StartElement{Name: mucUserNS},
+	)
+
+	err := client.Session.Send(ctx, stanza.Message{
+		To:   invite.Room.Bare(),
+		Type: stanza.NormalMessage,
+	}.Wrap(payload))
+	if err != nil {
+		return fmt.Errorf("unable to decline invitation to %s: %w", invite.Room.String(), err)
+	}
+	return nil
+}
+
+// AcceptInvitation joins the room of an invitation with nick using JoinMuc, bookmarking it with autojoin.
+// Returns the same values as JoinMuc.
+func (client *XmppClient) AcceptInvitation(ctx context.Context, invite RoomInvitation, nick string, histCFG MucLegacyHistoryConfig) (*muc.Channel, error, error) {
+	return client.JoinMuc(bookmarks.Channel{
+		JID:      invite.Room.Bare(),
+		Autojoin: true,
+		Nick:     nick,
+		Password: invite.Password,
+	}, histCFG, ctx)
+}
+
+// internalHandleMucUserMessage handles mediated invitations relayed by a room.
+func (client *XmppClient) internalHandleMucUserMessage(header stanza.Message, t xmlstream.TokenReadEncoder) error {
+	msg := mucUserMessage{}
+	err := xml.NewTokenDecoder(t).Decode(&msg)
+	if err != nil {
+		return err
+	}
+	if msg.X.Invite == nil {
+		return nil
+	}
+
+	invite := RoomInvitation{
+		Room:     header.From.Bare(),
+		Reason:   msg.X.Invite.Reason,
+		Password: msg.X.Password,
+	}
+	if from, err := jid.Parse(msg.X.Invite.From); err == nil {
+		invite.From = from
+	}
+	if msg.X.Invite.Continue != nil {
+		invite.Continue = true
+		invite.Thread = msg.X.Invite.Continue.Thread
+	}
+
+	client.emitInvitation(invite)
+	return nil
+}
+
+// internalHandleDirectInvite handles invitations sent to us directly.
+func (client *XmppClient) internalHandleDirectInvite(header stanza.Message, t xmlstream.TokenReadEncoder) error {
+	msg := directInviteMessage{}
+	err := xml.NewTokenDecoder(t).Decode(&msg)
+	if err != nil {
+		return err
+	}
+
+	client.emitInvitation(RoomInvitation{
+		Room:     msg.Invite.JID.Bare(),
+		From:     header.From,
+		Reason:   msg.Invite.Reason,
+		Password: msg.Invite.Password,
+		Continue: msg.Invite.Continue,
+		Thread:   msg.Invite.Thread,
+		Direct:   true,
+	})
+	return nil
+}
+
+// emitInvitation hands an invitation to the InvitationHandler, unless the inviter is blocked
+func (client *XmppClient) emitInvitation(invite RoomInvitation) {
+	//invitations are a common way to spam, so respect the block list here too
+	if client.FilterBlocked.Load() && !invite.From.Equal(jid.JID{}) && client.IsBlocked(invite.From) {
+		return
+	}
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.InvitationHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, invite)
+	}
+}
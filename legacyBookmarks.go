@@ -0,0 +1,334 @@
+package oasis_sdk
+
+// legacyBookmarks.go implements the bookmark storage of https://xmpp.org/extensions/xep-0048.html, either in
+// private XML storage as per https://xmpp.org/extensions/xep-0049.html or in PEP, for servers that don't
+// support https://xmpp.org/extensions/xep-0402.html
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	nsLegacyBookmarks      = "storage:bookmarks"
+	nsPubSubPublishOptions = "http://jabber.org/protocol/pubsub#publish-options"
+)
+
+// BookmarkStorage is where the server keeps our bookmarks
+type BookmarkStorage int
+
+const (
+	// BookmarkStoragePEP is one PEP item per room as per https://xmpp.org/extensions/xep-0402.html
+	BookmarkStoragePEP BookmarkStorage = iota
+	// BookmarkStorageLegacyPEP is a single PEP item holding every room as per https://xmpp.org/extensions/xep-0048.html
+	BookmarkStorageLegacyPEP
+	// BookmarkStoragePrivate is private XML storage as per https://xmpp.org/extensions/xep-0049.html
+	BookmarkStoragePrivate
+)
+
+// legacyConference is a room bookmark in legacy storage. Unknown children are the equivalent of
+// the extensions of modern bookmarks.
+type legacyConference struct {
+	JID        string   `xml:"jid,attr"`
+	Name       string   `xml:"name,attr,omitempty"`
+	Autojoin   bool     `xml:"autojoin,attr"`
+	Nick       string   `xml:"nick,omitempty"`
+	Password   string   `xml:"password,omitempty"`
+	Extensions []rawXML `xml:",any"`
+}
+
+// legacyStorage is the whole legacy bookmark list, written back as a single unit
+type legacyStorage struct {
+	XMLName     xml.Name           `xml:"storage:bookmarks storage"`
+	Conferences []legacyConference `xml:"conference"`
+	Other       []rawXML           `xml:",any"` //url bookmarks and anything else, kept when writing back
+}
+
+type privateQuery struct {
+	XMLName xml.Name `xml:"jabber:iq:private query"`
+	Storage legacyStorage
+}
+
+type dataFormField struct {
+	Var   string `xml:"var,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+type dataFormSubmit struct {
+	XMLName xml.Name        `xml:"jabber:x:data x"`
+	Type    string          `xml:"type,attr"`
+	Fields  []dataFormField `xml:"field"`
+}
+
+// legacyPEPPublish publishes the legacy storage to a private PEP node as per https://xmpp.org/extensions/xep-0048.html#storage-pubsub-upload
+type legacyPEPPublish struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/pubsub pubsub"`
+	Publish struct {
+		Node string `xml:"node,attr"`
+		Item struct {
+			ID      string `xml:"id,attr"`
+			Storage legacyStorage
+		} `xml:"item"`
+	} `xml:"publish"`
+	Options struct {
+		Form dataFormSubmit
+	} `xml:"publish-options"`
+}
+
+// MigrateBookmarks copies the bookmarks in legacy storage into modern bookmarks, keeping their nick,
+// password and extensions. Rooms that already have a modern bookmark only get the fields they are missing.
+// The legacy storage is left alone for older clients. Returns how many bookmarks were published.
+func (client *XmppClient) MigrateBookmarks(ctx context.Context) (int, error) {
+	if client.bookmarkStorage() != BookmarkStoragePEP {
+		return 0, errors.New("server does not support modern bookmarks")
+	}
+
+	//legacy bookmarks may be in either storage, depending on which clients wrote them
+	legacy := make(map[string]bookmarks.Channel)
+	var errs []error
+	for _, storage := range []BookmarkStorage{BookmarkStoragePrivate, BookmarkStorageLegacyPEP} {
+		s, err := client.fetchLegacyStorage(ctx, storage)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, channel := range s.channels() {
+			legacy[channel.JID.String()] = channel
+		}
+	}
+	if len(errs) == 2 {
+		return 0, errors.Join(errs...)
+	}
+
+	modern, err := client.fetchModernBookmarks(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("unable to fetch bookmarks: %w", err)
+	}
+
+	count := 0
+	errs = nil
+	for jidStr, old := range legacy {
+		merged, ok := modern[jidStr]
+		if ok {
+			//never overwrite what the modern bookmark already says
+			changed := false
+			if merged.Name == "" && old.Name != "" {
+				merged.Name = old.Name
+				changed = true
+			}
+			if merged.Nick == "" && old.Nick != "" {
+				merged.Nick = old.Nick
+				changed = true
+			}
+			if merged.Password == "" && old.Password != "" {
+				merged.Password = old.Password
+				changed = true
+			}
+			if len(merged.Extensions) == 0 && len(old.Extensions) > 0 {
+				merged.Extensions = old.Extensions
+				changed = true
+			}
+			if !changed {
+				continue
+			}
+		} else {
+			merged = old
+		}
+
+		err = client.PublishBookmark(merged, ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to migrate bookmark %s: %w", jidStr, err))
+			continue
+		}
+		count++
+	}
+	return count, errors.Join(errs...)
+}
+
+// bookmarkStorageFor works out the bookmark storage from the disco#info of our account
+func bookmarkStorageFor(accountInfo disco.Info) BookmarkStorage {
+	if hasFeature(accountInfo, bookmarks.NSCompat) || hasFeature(accountInfo, nsPubSubPublishOptions) {
+		return BookmarkStoragePEP
+	}
+	for _, identity := range accountInfo.Identity {
+		if identity.Category == "pubsub" && identity.Type == "pep" {
+			return BookmarkStorageLegacyPEP
+		}
+	}
+	return BookmarkStoragePrivate
+}
+
+// bookmarkStorage waits for discovery and returns the bookmark storage of the server
+func (client *XmppClient) bookmarkStorage() BookmarkStorage {
+	//without discovery assume a modern server
+	if client.AwaitDiscovery(client.Ctx) != nil {
+		return BookmarkStoragePEP
+	}
+	return client.ServerCapabilities().Bookmarks
+}
+
+// fetchLegacyBookmarks fetches the bookmarks from legacy storage, keyed by room JID
+func (client *XmppClient) fetchLegacyBookmarks(ctx context.Context, storage BookmarkStorage) (map[string]bookmarks.Channel, error) {
+	s, err := client.fetchLegacyStorage(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]bookmarks.Channel)
+	for _, channel := range s.channels() {
+		res[channel.JID.String()] = channel
+	}
+	return res, nil
+}
+
+// publishLegacyBookmark adds or replaces a bookmark in legacy storage, or removes it
+func (client *XmppClient) publishLegacyBookmark(ctx context.Context, storage BookmarkStorage, channel bookmarks.Channel, remove bool) error {
+	//the whole list is written at once, so changes must not interleave
+	client.legacyBookmarkLock.Lock()
+	defer client.legacyBookmarkLock.Unlock()
+
+	s, err := client.fetchLegacyStorage(ctx, storage)
+	if err != nil {
+		return err
+	}
+
+	conferences := s.Conferences[:0]
+	for _, conference := range s.Conferences {
+		j, err := jid.Parse(conference.JID)
+		if err == nil && j.Equal(channel.JID) {
+			continue
+		}
+		conferences = append(conferences, conference)
+	}
+	if !remove {
+		conferences = append(conferences, legacyConferenceFrom(channel))
+	}
+	s.Conferences = conferences
+
+	return client.storeLegacyStorage(ctx, storage, s)
+}
+
+// fetchLegacyStorage fetches the legacy bookmark list. A missing list is returned empty.
+func (client *XmppClient) fetchLegacyStorage(ctx context.Context, storage BookmarkStorage) (legacyStorage, error) {
+	switch storage {
+	case BookmarkStoragePrivate:
+		payload, err := marshalTokens(privateQuery{})
+		if err != nil {
+			return legacyStorage{}, err
+		}
+		resp := privateQuery{}
+		err = client.Session.UnmarshalIQElement(ctx, payload, stanza.IQ{Type: stanza.GetIQ}, &resp)
+		if err != nil {
+			return legacyStorage{}, fmt.Errorf("unable to fetch bookmarks from private storage: %w", err)
+		}
+		return resp.Storage, nil
+	case BookmarkStorageLegacyPEP:
+		s := legacyStorage{}
+		err := client.fetchPEPItem(ctx, client.JID.Bare(), nsLegacyBookmarks, "", &s)
+		if errors.Is(err, errNoPEPItem) || errors.Is(err, stanza.Error{Condition: stanza.ItemNotFound}) {
+			return legacyStorage{}, nil
+		}
+		if err != nil {
+			return legacyStorage{}, fmt.Errorf("unable to fetch legacy bookmarks from PEP: %w", err)
+		}
+		return s, nil
+	default:
+		return legacyStorage{}, errors.New("not a legacy bookmark storage")
+	}
+}
+
+// storeLegacyStorage writes the legacy bookmark list back
+func (client *XmppClient) storeLegacyStorage(ctx context.Context, storage BookmarkStorage, s legacyStorage) error {
+	var payload any
+	switch storage {
+	case BookmarkStoragePrivate:
+		payload = privateQuery{Storage: s}
+	case BookmarkStorageLegacyPEP:
+		//the node must stay private and keep its item as per https://xmpp.org/extensions/xep-0223.html
+		publish := legacyPEPPublish{}
+		publish.Publish.Node = nsLegacyBookmarks
+		publish.Publish.Item.ID = "current"
+		publish.Publish.Item.Storage = s
+		publish.Options.Form = dataFormSubmit{
+			Type: "submit",
+			Fields: []dataFormField{
+				{Var: "FORM_TYPE", Type: "hidden", Value: nsPubSubPublishOptions},
+				{Var: "pubsub#persist_items", Value: "true"},
+				{Var: "pubsub#access_model", Value: "whitelist"},
+			},
+		}
+		payload = publish
+	default:
+		return errors.New("not a legacy bookmark storage")
+	}
+
+	tokens, err := marshalTokens(payload)
+	if err != nil {
+		return err
+	}
+	err = client.Session.UnmarshalIQElement(ctx, tokens, stanza.IQ{Type: stanza.SetIQ}, nil)
+	if err != nil {
+		return fmt.Errorf("unable to store legacy bookmarks: %w", err)
+	}
+	return nil
+}
+
+// internalHandleLegacyBookmarkEvent applies legacy bookmark changes made by our other devices
+func (client *XmppClient) internalHandleLegacyBookmarkEvent(from jid.JID, items []pepItem) {
+	//modern servers mirror bookmarks into the legacy node, those are already handled
+	if !from.Equal(client.JID.Bare()) || len(items) == 0 ||
+		client.ServerCapabilities().Bookmarks != BookmarkStorageLegacyPEP {
+		return
+	}
+	s := legacyStorage{}
+	err := items[0].Payload.Decode(&s)
+	if err != nil {
+		return
+	}
+
+	fetched := make(map[string]bookmarks.Channel)
+	for _, channel := range s.channels() {
+		fetched[channel.JID.String()] = channel
+	}
+	client.applyRemoteBookmarkEvents(client.replaceBookmarks(fetched, false))
+}
+
+// channels converts the legacy room bookmarks, skipping ones with an invalid JID
+func (s legacyStorage) channels() []bookmarks.Channel {
+	res := make([]bookmarks.Channel, 0, len(s.Conferences))
+	for _, conference := range s.Conferences {
+		j, err := jid.Parse(conference.JID)
+		if err != nil {
+			continue
+		}
+		channel := bookmarks.Channel{
+			JID:      j.Bare(),
+			Autojoin: conference.Autojoin,
+			Name:     conference.Name,
+			Nick:     conference.Nick,
+			Password: conference.Password,
+		}
+		setBookmarkExtensions(&channel, conference.Extensions)
+		res = append(res, channel)
+	}
+	return res
+}
+
+// legacyConferenceFrom converts a bookmark to the legacy format, extensions become children of the conference
+func legacyConferenceFrom(channel bookmarks.Channel) legacyConference {
+	return legacyConference{
+		JID:        channel.JID.String(),
+		Name:       channel.Name,
+		Autojoin:   channel.Autojoin,
+		Nick:       channel.Nick,
+		Password:   channel.Password,
+		Extensions: bookmarkExtensions(channel),
+	}
+}
@@ -8,17 +8,20 @@ import (
 
 	"mellium.im/sasl"
 	"mellium.im/xmpp"
+	"mellium.im/xmpp/bookmarks"
 	"mellium.im/xmpp/dial"
+	"mellium.im/xmpp/disco"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/muc"
 	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/ping"
 	"mellium.im/xmpp/stanza"
 )
 
 // startServing is an internal function to add an internal handler to the session.
 // Most of this is just obtuse things inherited from mellium
 func (client *XmppClient) startServing() error {
-	err := client.Session.Send(client.Ctx, stanza.Presence{Type: stanza.AvailablePresence}.Wrap(nil))
+	err := client.sendSelfPresence(client.Ctx)
 	if err != nil {
 		return err
 	}
@@ -70,9 +73,21 @@ func (client *XmppClient) Connect() error {
 	client.isStartedLock.Unlock()
 	defer client.isStartedLock.Lock()
 
-	//TODO: do something with discoed services
+	//results and errors are reported through ServerCapabilities and the DiscoveryFinishedHandler
 	go client.DiscoServicesOnServer()
 
+	//make our display name visible to contacts as per https://xmpp.org/extensions/xep-0172.html
+	go client.publishDisplayName()
+
+	//fill the block list cache and subscribe to changes from our other devices
+	go client.loadBlockList()
+
+	//notice rooms that silently dropped us as per https://xmpp.org/extensions/xep-0410.html
+	go client.mucSelfPingLoop()
+
+	//join bookmarked rooms as per AutojoinLevel
+	go client.autojoinBookmarks()
+
 	return client.startServing()
 }
 
@@ -124,6 +139,15 @@ func (client *XmppClient) SetPresenceHandler(handler PresenceHandler) {
 	client.handlers.Lock.Unlock()
 }
 
+// SetDiscoveryFinishedHandler sets the handler function called when service discovery on the server completes.
+// The handler receives the typed report of everything discovered, also available from ServerCapabilities,
+// and the error that stopped discovery early, if any.
+func (client *XmppClient) SetDiscoveryFinishedHandler(handler DiscoveryFinishedHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.DiscoveryFinishedHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
 // CreateClient creates the client object using the login info object and returns it
 func CreateClient(login *LoginInfo) (*XmppClient, error) {
 
@@ -131,7 +155,39 @@ func CreateClient(login *LoginInfo) (*XmppClient, error) {
 	client := &XmppClient{
 		Login:       login,
 		MucChannels: make(map[string]*muc.Channel),
+		mucSubjects: make(map[string]RoomSubject),
+		bookmarks:   make(map[string]bookmarks.Channel),
+		mucJoins: mucJoinState{
+			joins: make(map[string]*mucJoin),
+		},
+		caps: capsCache{
+			features: make(map[string][]string),
+			entities: make(map[string]capsRef),
+			pending:  make(map[string]struct{}),
+		},
+		discoveryDone: make(chan struct{}),
+		avatars: avatarState{
+			hashes: make(map[string]string),
+		},
+		discoCache: discoCache{
+			entries: make(map[string]discoCacheEntry),
+		},
+		discoResponder: discoResponderState{
+			features: make(map[string]struct{}),
+			sdk:      make(map[string]struct{}),
+			nodes:    make(map[string]DiscoNode),
+		},
+		blockList: blockListState{
+			jids: make(map[string]jid.JID),
+		},
+		occupants: occupantState{
+			rooms:   make(map[string]map[string]Occupant),
+			created: make(map[string]struct{}),
+		},
 	}
+	client.FilterBlocked.Store(true)
+	client.AutojoinLevel.Store(AutojoinBookmarked)
+	client.loadCapsCache()
 	client.isStartedLock.Lock()
 	client.Ctx, client.CtxCancel = context.WithCancel(context.Background())
 
@@ -140,39 +196,127 @@ func CreateClient(login *LoginInfo) (*XmppClient, error) {
 		Local: "body",
 	}
 
-	client.Multiplexer = mux.New(
-		"jabber:client",
-
-		//provide object to hold muc state
-		muc.HandleClient(client.MucClient),
-
-		//handlers for chat messages
-		mux.MessageFunc(stanza.ChatMessage, messageNS, client.internalHandleDM),
-		mux.MessageFunc(stanza.GroupChatMessage, messageNS, client.internalHandleGroupMsg),
-
-		// Chat state handlers for direct messages
-		mux.MessageFunc(stanza.ChatMessage, activeNS, client.internalActiveChatstateReceiver),
-		mux.MessageFunc(stanza.ChatMessage, composingNS, client.internalComposingChatstateReciever),
-		mux.MessageFunc(stanza.ChatMessage, pausedNS, client.internalPausedChatstateReceiver),
-		mux.MessageFunc(stanza.ChatMessage, inactiveNS, client.internalInactiveChatstateReceiver),
-		mux.MessageFunc(stanza.ChatMessage, goneNS, client.internalGoneChatstateReceiver),
-
-		// Receipt handlers for direct messages
-		mux.MessageFunc(stanza.ChatMessage, deliveredNS, client.internalHandleDeliveryReceipt),
-		mux.MessageFunc(stanza.ChatMessage, displayedNS, client.internalHandleReadReceipt),
+	//every handler lists the features it handles, which we advertise in disco#info and caps
+	routes := []sdkRoute{
+		{
+			//provide object to hold muc state, its presences go through our occupant tracking first
+			features: []string{muc.NS},
+			handlers: []mux.Option{
+				mux.PresenceFunc(stanza.AvailablePresence, mucUserNS, client.internalHandleMucPresence),
+				mux.PresenceFunc(stanza.UnavailablePresence, mucUserNS, client.internalHandleMucPresence),
+				// Room invitations mediated through the room
+				mux.MessageFunc(stanza.NormalMessage, mucUserNS, client.internalHandleMucUserMessage),
+			},
+		},
+		{
+			// Room invitations sent directly
+			features: []string{muc.NSConf},
+			handlers: []mux.Option{
+				mux.MessageFunc(stanza.NormalMessage, directInviteNS, client.internalHandleDirectInvite),
+			},
+		},
+		{
+			//handlers for chat messages, which parse replies, fallbacks and the files they share
+			features: []string{"urn:xmpp:reply:0", "urn:xmpp:fallback:0", "jabber:x:oob", "urn:xmpp:sims:1", nsSFS},
+			handlers: []mux.Option{
+				mux.MessageFunc(stanza.ChatMessage, messageNS, client.internalHandleDM),
+				mux.MessageFunc(stanza.GroupChatMessage, messageNS, client.internalHandleGroupMsg),
+				mux.MessageFunc(stanza.GroupChatMessage, subjectNS, client.internalHandleSubject),
 
-		// Chat state handlers for group messages
-		mux.MessageFunc(stanza.GroupChatMessage, activeNS, client.internalActiveChatstateReceiver),
-		mux.MessageFunc(stanza.GroupChatMessage, composingNS, client.internalComposingChatstateReciever),
-		mux.MessageFunc(stanza.GroupChatMessage, pausedNS, client.internalPausedChatstateReceiver),
-		mux.MessageFunc(stanza.GroupChatMessage, inactiveNS, client.internalInactiveChatstateReceiver),
-		mux.MessageFunc(stanza.GroupChatMessage, goneNS, client.internalGoneChatstateReceiver),
+				// Files shared without a body, and sources attached to files shared earlier
+				mux.MessageFunc(stanza.ChatMessage, fileSharingNS, client.internalHandleFileMessage),
+				mux.MessageFunc(stanza.GroupChatMessage, fileSharingNS, client.internalHandleFileMessage),
+				mux.MessageFunc(stanza.ChatMessage, fileSourcesNS, client.internalHandleFileMessage),
+				mux.MessageFunc(stanza.GroupChatMessage, fileSourcesNS, client.internalHandleFileMessage),
 
-		// Receipt handlers for group messages
-		mux.MessageFunc(stanza.GroupChatMessage, displayedNS, client.internalHandleReadReceipt),
+				// Room history we missed, fetched from the room archive after a rejoin
+				mux.MessageFunc(stanza.NormalMessage, mamResultNS, client.internalHandleMamResult),
+			},
+		},
+		{
+			// Answer pings, including self-pings rooms forward to us
+			features: []string{ping.NS},
+			handlers: []mux.Option{ping.Handle()},
+		},
+		{
+			// Chat state handlers for direct and group messages
+			features: []string{"http://jabber.org/protocol/chatstates"},
+			handlers: []mux.Option{
+				mux.MessageFunc(stanza.ChatMessage, activeNS, client.internalActiveChatstateReceiver),
+				mux.MessageFunc(stanza.ChatMessage, composingNS, client.internalComposingChatstateReciever),
+				mux.MessageFunc(stanza.ChatMessage, pausedNS, client.internalPausedChatstateReceiver),
+				mux.MessageFunc(stanza.ChatMessage, inactiveNS, client.internalInactiveChatstateReceiver),
+				mux.MessageFunc(stanza.ChatMessage, goneNS, client.internalGoneChatstateReceiver),
+				mux.MessageFunc(stanza.GroupChatMessage, activeNS, client.internalActiveChatstateReceiver),
+				mux.MessageFunc(stanza.GroupChatMessage, composingNS, client.internalComposingChatstateReciever),
+				mux.MessageFunc(stanza.GroupChatMessage, pausedNS, client.internalPausedChatstateReceiver),
+				mux.MessageFunc(stanza.GroupChatMessage, inactiveNS, client.internalInactiveChatstateReceiver),
+				mux.MessageFunc(stanza.GroupChatMessage, goneNS, client.internalGoneChatstateReceiver),
+			},
+		},
+		{
+			// Delivery receipts for direct messages
+			features: []string{"urn:xmpp:receipts"},
+			handlers: []mux.Option{
+				mux.MessageFunc(stanza.ChatMessage, deliveredNS, client.internalHandleDeliveryReceipt),
+			},
+		},
+		{
+			// Read markers for direct and group messages
+			features: []string{"urn:xmpp:chat-markers:0"},
+			handlers: []mux.Option{
+				mux.MessageFunc(stanza.ChatMessage, displayedNS, client.internalHandleReadReceipt),
+				mux.MessageFunc(stanza.GroupChatMessage, displayedNS, client.internalHandleReadReceipt),
+			},
+		},
+		{
+			handlers: []mux.Option{
+				mux.PresenceFunc(stanza.AvailablePresence, vanityPresenceNS, client.internalHandleVanityPresence),
+			},
+		},
+		{
+			// PEP notifications, which servers send as either headline or normal messages
+			features: []string{nsAvatarMetadata + "+notify", nsNick + "+notify", bookmarks.NSNotify, nsLegacyBookmarks + "+notify"},
+			handlers: []mux.Option{
+				mux.MessageFunc(stanza.HeadlineMessage, pepEventNS, client.internalHandlePEPEvent),
+				mux.MessageFunc(stanza.NormalMessage, pepEventNS, client.internalHandlePEPEvent),
+			},
+		},
+		{
+			// Entity capabilities of others
+			features: []string{disco.NSCaps, NSECaps2},
+			handlers: []mux.Option{
+				disco.HandleCaps(client.internalHandleCapsPresence),
+				mux.PresenceFunc(stanza.AvailablePresence, ecaps2NS, client.internalHandleECaps2Presence),
+				mux.PresenceFunc(stanza.UnavailablePresence, xml.Name{}, client.internalHandleUnavailableCaps),
+			},
+		},
+		{
+			// Service discovery responder for queries about us
+			features: []string{disco.NSInfo, disco.NSItems},
+			handlers: []mux.Option{
+				mux.IQFunc(stanza.GetIQ, discoInfoNS, client.internalHandleDiscoInfo),
+				mux.IQFunc(stanza.GetIQ, discoItemsNS, client.internalHandleDiscoItems),
+			},
+		},
+		{
+			// Block list pushes from the server, which peers don't need to know about
+			handlers: []mux.Option{
+				mux.IQFunc(stanza.SetIQ, blockPushNS, client.internalHandleBlockPush),
+				mux.IQFunc(stanza.SetIQ, unblockPushNS, client.internalHandleBlockPush),
+			},
+		},
+	}
 
-		mux.PresenceFunc(stanza.AvailablePresence, vanityPresenceNS, client.internalHandleVanityPresence),
-	)
+	var handlers []mux.Option
+	for _, route := range routes {
+		handlers = append(handlers, route.handlers...)
+		for _, ns := range route.features {
+			client.discoResponder.features[ns] = struct{}{}
+			client.discoResponder.sdk[ns] = struct{}{}
+		}
+	}
+	client.Multiplexer = mux.New("jabber:client", handlers...)
 
 	//string to jid object
 	j, err := jid.Parse(login.User)
@@ -0,0 +1,255 @@
+package oasis_sdk
+
+// mediaInfo.go works out what we know about a file while it is uploaded: its content type, hash,
+// and the dimensions or duration of images, audio and video. Everything is read from the stream
+// as it passes, so files are never buffered whole.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// how much of the start of a file is kept to find image dimensions and media headers
+	mediaHeadSize = 1 << 20
+	// how much of the end of a file is kept, where mp4 files without faststart and ogg keep their duration
+	mediaTailSize = 1 << 20
+	// how much is read ahead to sniff the content type
+	sniffSize = 512
+)
+
+// UploadResult is what we know about an uploaded file, ready to be embedded in file metadata of messages
+type UploadResult struct {
+	GetURL      string
+	Name        string
+	Size        int64
+	ContentType string
+	SHA256      []byte
+	Width       int           // images and video, 0 if unknown
+	Height      int           // images and video, 0 if unknown
+	Duration    time.Duration // audio and video, 0 if unknown
+	Thumbnail   *Thumbnail    // small preview of images, nil if none was made
+	Blurhash    string        // blurred placeholder of images, empty if none was made
+}
+
+// mediaProbe watches the bytes of a file go by, hashing them and keeping its start and end.
+// Images are decoded along the way to make their preview.
+type mediaProbe struct {
+	hash    hash.Hash
+	head    []byte
+	tail    []byte
+	preview *imagePreview
+}
+
+func newMediaProbe(contentType string, preview bool) *mediaProbe {
+	probe := &mediaProbe{
+		hash: sha256.New(),
+	}
+	//only formats the standard library decodes
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		if preview {
+			probe.preview = newImagePreview()
+		}
+	}
+	return probe
+}
+
+// Write implements io.Writer, so the probe can be fed by an io.TeeReader
+func (probe *mediaProbe) Write(p []byte) (int, error) {
+	probe.hash.Write(p)
+	if probe.preview != nil {
+		probe.preview.Write(p)
+	}
+	if room := mediaHeadSize - len(probe.head); room > 0 {
+		probe.head = append(probe.head, p[:min(room, len(p))]...)
+	}
+	probe.tail = append(probe.tail, p...)
+	if len(probe.tail) > mediaTailSize {
+		probe.tail = probe.tail[len(probe.tail)-mediaTailSize:]
+	}
+	return len(p), nil
+}
+
+// close marks the end of the file, err is why the upload stopped early. Must be called before fill.
+func (probe *mediaProbe) close(err error) {
+	if probe.preview != nil {
+		probe.preview.close(err)
+	}
+}
+
+// fill completes an upload result with what the probe saw
+func (probe *mediaProbe) fill(res *UploadResult) {
+	res.SHA256 = probe.hash.Sum(nil)
+	if probe.preview != nil {
+		res.Thumbnail, res.Blurhash = probe.preview.thumbnail, probe.preview.blurhash
+	}
+
+	if config, _, err := image.DecodeConfig(bytes.NewReader(probe.head)); err == nil {
+		res.Width, res.Height = config.Width, config.Height
+	} else if width, height, ok := webpSize(probe.head); ok {
+		res.Width, res.Height = width, height
+	}
+
+	switch {
+	case isMP4(probe.head):
+		res.Duration = mp4Duration(probe.head)
+		if res.Duration == 0 {
+			res.Duration = mp4Duration(probe.tail)
+		}
+	case bytes.HasPrefix(probe.head, []byte("OggS")):
+		res.Duration = oggDuration(probe.head, probe.tail)
+	case len(probe.head) >= 12 && string(probe.head[:4]) == "RIFF" && string(probe.head[8:12]) == "WAVE":
+		res.Duration = wavDuration(probe.head)
+	}
+}
+
+// detectContentType picks the content type of a file from its name, or from its first bytes
+// if the extension is unknown. Returns the reader to use in place of r, since sniffing consumes it.
+func detectContentType(name string, r io.Reader) (string, io.Reader) {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType, r
+	}
+	rewind, seekable := rewinder(r)
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, head)
+	head = head[:n]
+	//put back what we read, seeking if we can so the upload can be sent again
+	if !seekable || rewind() != nil {
+		r = io.MultiReader(bytes.NewReader(head), r)
+	}
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "application/octet-stream", r
+	}
+	return http.DetectContentType(head), r
+}
+
+// webpSize reads the dimensions from the header of a WebP image, which the standard library can't decode
+func webpSize(data []byte) (int, int, bool) {
+	if len(data) < 30 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, false
+	}
+	chunk := data[12:]
+	switch string(chunk[:4]) {
+	case "VP8 ":
+		//lossy, the frame header follows the start code
+		if chunk[11] != 0x9d || chunk[12] != 0x01 || chunk[13] != 0x2a {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint16(chunk[14:]) & 0x3fff), int(binary.LittleEndian.Uint16(chunk[16:]) & 0x3fff), true
+	case "VP8L":
+		//lossless, 14 bit dimensions minus one
+		if chunk[8] != 0x2f {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(chunk[9:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, true
+	case "VP8X":
+		//extended, 24 bit canvas size minus one
+		width := int(chunk[12]) | int(chunk[13])<<8 | int(chunk[14])<<16
+		height := int(chunk[15]) | int(chunk[16])<<8 | int(chunk[17])<<16
+		return width + 1, height + 1, true
+	}
+	return 0, 0, false
+}
+
+// isMP4 reports whether data starts like an ISO base media file, such as mp4, m4a or mov
+func isMP4(data []byte) bool {
+	return len(data) >= 12 && (string(data[4:8]) == "ftyp" || string(data[4:8]) == "moov" || string(data[4:8]) == "wide")
+}
+
+// mp4Duration finds the movie header box in data and reads the duration from it
+func mp4Duration(data []byte) time.Duration {
+	i := bytes.Index(data, []byte("mvhd"))
+	if i < 0 {
+		return 0
+	}
+	box := data[i+4:]
+	if len(box) < 1 {
+		return 0
+	}
+	var timescale, duration uint64
+	switch box[0] {
+	case 0:
+		//version, flags, creation and modification time, then 32 bit timescale and duration
+		if len(box) < 20 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(box[12:]))
+		duration = uint64(binary.BigEndian.Uint32(box[16:]))
+	case 1:
+		//64 bit times and duration
+		if len(box) < 32 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(box[20:]))
+		duration = binary.BigEndian.Uint64(box[24:])
+	default:
+		return 0
+	}
+	if timescale == 0 {
+		return 0
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+}
+
+// oggDuration reads the sample rate from the first page and the position of the last page.
+// Opus always counts at 48kHz, Vorbis announces its rate.
+func oggDuration(head []byte, tail []byte) time.Duration {
+	var rate uint64
+	switch {
+	case bytes.Contains(head[:min(len(head), 256)], []byte("OpusHead")):
+		rate = 48000
+	default:
+		i := bytes.Index(head[:min(len(head), 256)], []byte("\x01vorbis"))
+		if i < 0 || len(head) < i+16 {
+			return 0
+		}
+		rate = uint64(binary.LittleEndian.Uint32(head[i+12:]))
+	}
+
+	//the granule position of the last page is the number of samples
+	i := bytes.LastIndex(tail, []byte("OggS"))
+	if i < 0 || len(tail) < i+14 || rate == 0 {
+		return 0
+	}
+	samples := binary.LittleEndian.Uint64(tail[i+6:])
+	if samples == ^uint64(0) {
+		return 0
+	}
+	return time.Duration(float64(samples) / float64(rate) * float64(time.Second))
+}
+
+// wavDuration reads the byte rate and data size from a WAVE header
+func wavDuration(head []byte) time.Duration {
+	var byteRate, dataSize uint32
+	for i := 12; i+8 <= len(head); {
+		id := string(head[i : i+4])
+		size := binary.LittleEndian.Uint32(head[i+4:])
+		switch id {
+		case "fmt ":
+			if i+20 <= len(head) {
+				byteRate = binary.LittleEndian.Uint32(head[i+16:])
+			}
+		case "data":
+			dataSize = size
+		}
+		if dataSize > 0 && byteRate > 0 {
+			break
+		}
+		//chunks are padded to an even size
+		i += 8 + int(size) + int(size&1)
+	}
+	if byteRate == 0 {
+		return 0
+	}
+	return time.Duration(float64(dataSize) / float64(byteRate) * float64(time.Second))
+}
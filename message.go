@@ -14,13 +14,8 @@ import (
 // automatically determines whether to send a groupchatmessage or chatmessage.
 func (client *XmppClient) SendText(to jid.JID, body string) error {
 
-	//determine if we're sending to a group chat
-	var msgType stanza.MessageType
-	if client.MucChannels[to.String()] == nil {
-		msgType = stanza.ChatMessage
-	} else {
-		msgType = stanza.GroupChatMessage
-	}
+	//determine if we're sending to a group chat, or privately to one of its occupants
+	msgType, mucUser := client.messageTypeFor(to)
 
 	msg := XMPPChatMessage{
 		Message: stanza.Message{
@@ -28,7 +23,8 @@ func (client *XmppClient) SendText(to jid.JID, body string) error {
 			Type: msgType,
 		},
 		ChatMessageBody: ChatMessageBody{
-			Body: &body,
+			Body:    &body,
+			MUCUser: mucUser,
 		},
 	}
 	err := client.Session.Encode(client.Ctx, msg)
@@ -36,47 +32,21 @@ func (client *XmppClient) SendText(to jid.JID, body string) error {
 }
 
 /*
-SendSingleFileMessage sends a url as a message with a single file.
-As of now, it only implements https://xmpp.org/extensions/xep-0066.html#x-oob;
-however, dual support for xep-0066 and https://xmpp.org/extensions/xep-0447.html
-is planned. To is the jid you wish to send the message to, url is the url to the file
-as per https://xmpp.org/extensions/xep-0066.html#nonhttp, description is the optional
-description, which seems to go unused by most clients. More arguments will be added to support
-0447.
+SendSingleFileMessage sends a url as a message with a single file, as per https://xmpp.org/extensions/xep-0447.html
+with https://xmpp.org/extensions/xep-0066.html#x-oob as fallback. To is the jid you wish to send the message to,
+url is the url to the file as per https://xmpp.org/extensions/xep-0066.html#nonhttp, description is the optional
+description, which seems to go unused by most clients. Use SendAttachments to send the metadata of the file as well,
+such as from AttachmentFromUpload.
 */
 func (client *XmppClient) SendSingleFileMessage(to jid.JID, url string, description *string) error {
-
-	//determine if we're sending to a group chat
-	var msgType stanza.MessageType
-	if client.MucChannels[to.String()] == nil {
-		msgType = stanza.ChatMessage
-	} else {
-		msgType = stanza.GroupChatMessage
+	attachment := Attachment{
+		Sources: []string{url},
+		Name:    nameFromURL(url),
 	}
-
-	oob := OutOfBandMedia{
-		URL:         url,
-		Description: description,
+	if description != nil {
+		attachment.Description = *description
 	}
-
-	msg := XMPPChatMessage{
-		Message: stanza.Message{
-			To:   to,
-			Type: msgType,
-		},
-		ChatMessageBody: ChatMessageBody{
-			Body:           &url,
-			OutOfBandMedia: &oob,
-		},
-	}
-
-	fmt.Println(msg)
-
-	err := client.Session.Encode(client.Ctx, msg)
-
-	fmt.Println("sent image")
-	return err
-
+	return client.SendAttachments(to, attachment)
 }
 
 // ReplyToEvent replies to a message event with body as per https://xmpp.org/extensions/xep-0461.html
@@ -86,6 +56,13 @@ func (client *XmppClient) ReplyToEvent(originalMsg *XMPPChatMessage, body string
 	replyTo := originalMsg.From
 	to := replyTo.Bare()
 
+	//private messages in a room are answered to the occupant, not the room
+	var mucUser *MUCUser
+	if originalMsg.IsMucPrivate() {
+		to = replyTo
+		mucUser = &MUCUser{}
+	}
+
 	//name to include in fallback
 	/*
 	var readableReplyTo string
@@ -140,6 +117,7 @@ func (client *XmppClient) ReplyToEvent(originalMsg *XMPPChatMessage, body string
 			Body:     &b,
 			Reply:    &replyStanza,
 			Fallback: []Fallback{replyFallback},
+			MUCUser:  mucUser,
 		},
 	}
 	return client.Session.Encode(client.Ctx, msg)
@@ -147,13 +125,19 @@ func (client *XmppClient) ReplyToEvent(originalMsg *XMPPChatMessage, body string
 
 func (client *XmppClient) internalHandleDM(header stanza.Message, t xmlstream.TokenReadEncoder) error {
 
-	//get handler with lock
+	//the server should already drop these, but don't rely on it
+	if client.FilterBlocked.Load() && client.IsBlocked(header.From) {
+		return nil
+	}
+
+	//get handlers with lock
 	client.handlers.Lock.Lock()
 	handler := client.handlers.DmHandler
+	privateHandler := client.handlers.MucPrivateMessageHandler
 	client.handlers.Lock.Unlock()
 
 	//nothing to do if theres no handler
-	if handler == nil {
+	if handler == nil && privateHandler == nil {
 		return nil
 	}
 
@@ -169,19 +153,40 @@ func (client *XmppClient) internalHandleDM(header stanza.Message, t xmlstream.To
 		ChatMessageBody: body,
 	}
 
+	//private messages from room occupants go to their own handler when one is set
+	client.mucLock.RLock()
+	ch := client.MucChannels[header.From.Bare().String()]
+	client.mucLock.RUnlock()
+	if msg.MUCUser == nil && ch != nil && header.From.Resourcepart() != "" {
+		//not every room marks private messages, but a chat message from an occupant is always one
+		msg.MUCUser = &MUCUser{}
+	}
+	private := msg.IsMucPrivate() && privateHandler != nil
+	if !private && handler == nil {
+		return nil
+	}
+
 	//mark as received if requested, and not group chat as per https://xmpp.org/extensions/xep-0184.html#when-groupchat
 	if msg.RequestingDeliveryReceipt() {
 		go client.MarkAsDelivered(&msg)
 	}
 
 	msg.ParseReply()
+	msg.ParseAttachments()
 
 	//call handler and return to connection
-	handler(client, &msg)
+	if private {
+		privateHandler(client, ch, &msg)
+	} else {
+		handler(client, &msg)
+	}
 	return nil
 }
 
 func (client *XmppClient) internalHandleGroupMsg(header stanza.Message, t xmlstream.TokenReadEncoder) error {
+	//any message from the room shows we are still in it
+	client.touchRoom(header.From)
+
 	//get handler with lock
 	client.handlers.Lock.Lock()
 	handler := client.handlers.GroupMessageHandler
@@ -215,6 +220,7 @@ func (client *XmppClient) internalHandleGroupMsg(header stanza.Message, t xmlstr
 	//no delivery receipt as per https://xmpp.org/extensions/xep-0184.html#when-groupchat
 
 	msg.ParseReply()
+	msg.ParseAttachments()
 
 	//call handler and return to connection
 	handler(client, ch, msg)
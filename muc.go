@@ -2,15 +2,23 @@ package oasis_sdk
 
 import (
 	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"time"
 
+	"mellium.im/xmlstream"
 	"mellium.im/xmpp/bookmarks"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/muc"
+	"mellium.im/xmpp/stanza"
 )
 
+// ------ mellium routing namespaces -------
+var subjectNS = xml.Name{
+	Local: "subject",
+}
+
 // MucLegacyHistoryConfig is the configuration to fetch legacy muc history on join
 // for most uses this is obsoleted by mam, which can be fetched separately
 type MucLegacyHistoryConfig struct {
@@ -19,6 +27,18 @@ type MucLegacyHistoryConfig struct {
 	Since    *time.Time
 }
 
+// RoomSubject is the topic of a room, sent when joining and whenever it changes
+type RoomSubject struct {
+	Subject string
+	Nick    string // occupant who set it, empty when set by the room itself
+}
+
+type subjectMessage struct {
+	stanza.Message
+	Subject *string `xml:"subject"`
+	Body    *string `xml:"body"`
+}
+
 // ConnectMuc connects to a Multi-User Chat (MUC) using the provided bookmark and Legacy history configuration.
 // It returns the joined MUC channel or an error if the connection fails.
 // The function validates the provided bookmark, applies history settings, and manages the client's active MUC channels.
@@ -56,6 +76,9 @@ func (client *XmppClient) ConnectMuc(bookmark bookmarks.Channel, histCFG MucLega
 		opts = append(opts, muc.Since(*histCFG.Since))
 	}
 
+	//the room sends the full occupant list again on join
+	client.resetOccupants(bookmark.JID)
+
 	ch, err := client.MucClient.Join(ctx, j, client.Session, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("mellium unable to join muc %s: %w",
@@ -63,24 +86,27 @@ func (client *XmppClient) ConnectMuc(bookmark bookmarks.Channel, histCFG MucLega
 	}
 
 	client.mucLock.Lock()
-	defer client.mucLock.Unlock()
 	client.MucChannels[bookmark.JID.String()] = ch
+	client.mucLock.Unlock()
+
+	//keep what we joined with, so we can join the same way if the room drops us
+	client.rememberJoin(bookmark, histCFG)
 
 	return ch, nil
 }
 
 // DisconnectMuc disconnects the client from a specified MUC (Multi-User Chat) using the provided reason and context.
-// It locks the mucLock mutex, retrieves the associated MUC channel, and leaves the MUC if found.
+// It retrieves the associated MUC channel under the mucLock mutex, and leaves the MUC if found.
 // Returns an error if the MUC channel is not found or if a failure occurs while leaving the MUC.
 func (client *XmppClient) DisconnectMuc(mucStr string, reason string, ctx context.Context) error {
-	client.mucLock.Lock()
-	defer client.mucLock.Unlock()
-
+	client.mucLock.RLock()
 	ch, ok := client.MucChannels[mucStr]
+	client.mucLock.RUnlock()
 	if !ok {
 		return fmt.Errorf("muc channel '%s' not found", mucStr)
 	}
 
+	//leave without holding the lock, our unavailable presence needs it to forget the room
 	err := ch.Leave(ctx, reason)
 	if err != nil {
 		return fmt.Errorf("mellium unable to leave muc %s: %w", mucStr, err)
@@ -97,10 +123,9 @@ func (client *XmppClient) LeaveMuc(mucStr string, reason string, ctx context.Con
 	//just hold the error and still try the second part
 	err1 := client.ToggleAutojoin(mucStr, false, context.WithoutCancel(ctx))
 
-	client.mucLock.Lock()
-	defer client.mucLock.Unlock()
-
+	client.mucLock.RLock()
 	muc, ok := client.MucChannels[mucStr]
+	client.mucLock.RUnlock()
 	if !ok {
 		//we have both error values
 		err2 := fmt.Errorf("muc channel '%s' not found", mucStr)
@@ -122,3 +147,157 @@ func (client *XmppClient) JoinMuc(bookmark bookmarks.Channel, histCFG MucLegacyH
 
 	return muc, err1, err2
 }
+
+// SetSubjectHandler sets the handler function called when the subject of a room we are in is received or changes.
+func (client *XmppClient) SetSubjectHandler(handler SubjectHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.SubjectHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// SetMucPrivateMessageHandler sets the handler function for private messages from occupants of a room.
+// Without one they are delivered to the DmHandler, with IsMucPrivate reporting true.
+func (client *XmppClient) SetMucPrivateMessageHandler(handler MucPrivateMessageHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.MucPrivateMessageHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// Subject returns the last known subject of a room we are in.
+func (client *XmppClient) Subject(room jid.JID) (RoomSubject, bool) {
+	client.mucLock.RLock()
+	defer client.mucLock.RUnlock()
+	subject, ok := client.mucSubjects[room.Bare().String()]
+	return subject, ok
+}
+
+// SetSubject changes the subject of a room as per https://xmpp.org/extensions/xep-0045.html#subject-mod
+// An empty subject clears it.
+func (client *XmppClient) SetSubject(ctx context.Context, room jid.JID, subject string) error {
+	msg := subjectMessage{
+		Message: stanza.Message{
+			To:   room.Bare(),
+			Type: stanza.GroupChatMessage,
+		},
+		Subject: &subject,
+	}
+	err := client.Session.Encode(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("unable to set subject of %s: %w", room.Bare().String(), err)
+	}
+	return nil
+}
+
+// ChangeNick changes our nickname in a room we are in as per https://xmpp.org/extensions/xep-0045.html#changenick
+// The bookmark of the room, if any, is updated to the new nick.
+func (client *XmppClient) ChangeNick(ctx context.Context, room jid.JID, nick string) error {
+	room = room.Bare()
+
+	client.mucLock.RLock()
+	_, ok := client.MucChannels[room.String()]
+	client.mucLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("muc channel '%s' not found", room.String())
+	}
+
+	newJID, err := room.WithResource(nick)
+	if err != nil {
+		return fmt.Errorf("invalid nick %s: %w", nick, err)
+	}
+
+	//mellium has no nick changes, so join under the new nick. The room sees we are already in and
+	//renames us instead, and the new channel completes once our presence under the new nick arrives
+	ch, err := client.MucClient.JoinPresence(ctx, stanza.Presence{To: newJID}, client.Session)
+	if err != nil {
+		return fmt.Errorf("unable to change nick in %s: %w", room.String(), err)
+	}
+
+	client.mucLock.Lock()
+	client.MucChannels[room.String()] = ch
+	client.mucLock.Unlock()
+	client.setJoinNick(room, nick)
+
+	//keep the bookmark in sync so we rejoin with the new nick
+	client.bookmarkLock.RLock()
+	bookmark, ok := client.bookmarks[room.String()]
+	client.bookmarkLock.RUnlock()
+	if ok && bookmark.Nick != nick {
+		bookmark.Nick = nick
+		err = client.PublishBookmark(bookmark, ctx)
+		if err != nil {
+			return fmt.Errorf("nick changed, but unable to update bookmark: %w", err)
+		}
+	}
+	return nil
+}
+
+// SendPrivateMessage sends a private message to an occupant of a room as per
+// https://xmpp.org/extensions/xep-0045.html#privatemessage, to is the occupant JID room@service/nick.
+func (client *XmppClient) SendPrivateMessage(to jid.JID, body string) error {
+	if to.Resourcepart() == "" {
+		return errors.New("private messages need the occupant JID including the nick")
+	}
+	msg := XMPPChatMessage{
+		Message: stanza.Message{
+			To:   to,
+			Type: stanza.ChatMessage,
+		},
+		ChatMessageBody: ChatMessageBody{
+			Body:    &body,
+			MUCUser: &MUCUser{},
+		},
+	}
+	return client.Session.Encode(client.Ctx, msg)
+}
+
+// messageTypeFor picks the message type for to: groupchat for a room we are in, chat otherwise.
+// Occupants of a room we are in get a chat message marked as private, which is returned as well.
+func (client *XmppClient) messageTypeFor(to jid.JID) (stanza.MessageType, *MUCUser) {
+	client.mucLock.RLock()
+	ch := client.MucChannels[to.Bare().String()]
+	client.mucLock.RUnlock()
+
+	switch {
+	case ch == nil:
+		return stanza.ChatMessage, nil
+	case to.Resourcepart() == "":
+		return stanza.GroupChatMessage, nil
+	default:
+		return stanza.ChatMessage, &MUCUser{}
+	}
+}
+
+// internalHandleSubject records the subject of a room, sent as a message with a subject and no body
+// as per https://xmpp.org/extensions/xep-0045.html#enter-subject
+func (client *XmppClient) internalHandleSubject(header stanza.Message, t xmlstream.TokenReadEncoder) error {
+	msg := subjectMessage{}
+	err := xml.NewTokenDecoder(t).Decode(&msg)
+	if err != nil {
+		return err
+	}
+	//a message with a body is a normal message that happens to have a subject
+	if msg.Subject == nil || msg.Body != nil {
+		return nil
+	}
+
+	room := header.From.Bare()
+	client.touchRoom(room)
+	subject := RoomSubject{
+		Subject: *msg.Subject,
+		Nick:    header.From.Resourcepart(),
+	}
+
+	client.mucLock.Lock()
+	client.mucSubjects[room.String()] = subject
+	client.mucLock.Unlock()
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.SubjectHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, room, subject)
+	}
+	return nil
+}
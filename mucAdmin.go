@@ -0,0 +1,153 @@
+package oasis_sdk
+
+// mucAdmin.go implements moderating rooms through roles and affiliations as per
+// https://xmpp.org/extensions/xep-0045.html#moderator and https://xmpp.org/extensions/xep-0045.html#admin
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/muc"
+	"mellium.im/xmpp/stanza"
+)
+
+// NSMucAdmin is the namespace of room administration requests
+const NSMucAdmin = "http://jabber.org/protocol/muc#admin"
+
+// Typed errors a room answers administration requests with, compare using errors.Is
+var (
+	// ErrMucForbidden is returned when we lack the role or affiliation for a change, or the target outranks us
+	ErrMucForbidden = stanza.Error{Condition: stanza.Forbidden}
+	// ErrMucNotAllowed is returned when the change is not allowed at all, such as demoting the last owner
+	ErrMucNotAllowed = stanza.Error{Condition: stanza.NotAllowed}
+	// ErrMucNotAcceptable is returned when the target nick is not in the room
+	ErrMucNotAcceptable = stanza.Error{Condition: stanza.NotAcceptable}
+	// ErrMucConflict is returned when the change would conflict with the room state, such as removing the only owner
+	ErrMucConflict = stanza.Error{Condition: stanza.Conflict}
+	// ErrMucItemNotFound is returned when the room does not exist
+	ErrMucItemNotFound = stanza.Error{Condition: stanza.ItemNotFound}
+	// ErrMucBadRequest is returned when the room did not understand the request
+	ErrMucBadRequest = stanza.Error{Condition: stanza.BadRequest}
+)
+
+// RoomAffiliation is an entry of an affiliation list of a room
+type RoomAffiliation struct {
+	JID         jid.JID
+	Affiliation muc.Affiliation
+	Nick        string // optional, the reserved nick of the user
+	Reason      string // optional, such as why someone was banned
+}
+
+// mucAdminItem is an item of a muc#admin query. Roles and affiliations are kept as strings
+// since "none" is a meaningful value that mellium would leave out.
+type mucAdminItem struct {
+	JID         string `xml:"jid,attr,omitempty"`
+	Nick        string `xml:"nick,attr,omitempty"`
+	Role        string `xml:"role,attr,omitempty"`
+	Affiliation string `xml:"affiliation,attr,omitempty"`
+	Reason      string `xml:"reason,omitempty"`
+}
+
+type mucAdminQuery struct {
+	XMLName xml.Name       `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []mucAdminItem `xml:"item"`
+}
+
+// SetRole changes the role of an occupant by nick. Moderators may kick and grant or revoke voice,
+// admins and owners may also grant or revoke moderator.
+func (client *XmppClient) SetRole(ctx context.Context, room jid.JID, nick string, role muc.Role, reason string) error {
+	err := client.mucAdmin(ctx, stanza.SetIQ, room, mucAdminItem{
+		Nick:   nick,
+		Role:   role.String(),
+		Reason: reason,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("unable to set role of %s in %s to %s: %w", nick, room.Bare().String(), role.String(), err)
+	}
+	return nil
+}
+
+// Kick removes an occupant from the room by nick, they may join again unless also banned.
+func (client *XmppClient) Kick(ctx context.Context, room jid.JID, nick string, reason string) error {
+	return client.SetRole(ctx, room, nick, muc.RoleNone, reason)
+}
+
+// GrantVoice lets an occupant speak in a moderated room.
+func (client *XmppClient) GrantVoice(ctx context.Context, room jid.JID, nick string, reason string) error {
+	return client.SetRole(ctx, room, nick, muc.RoleParticipant, reason)
+}
+
+// RevokeVoice makes an occupant a visitor, who cannot speak in a moderated room.
+func (client *XmppClient) RevokeVoice(ctx context.Context, room jid.JID, nick string, reason string) error {
+	return client.SetRole(ctx, room, nick, muc.RoleVisitor, reason)
+}
+
+// SetAffiliation changes the long lived affiliation of a user by bare JID. Admins may ban and
+// manage members, owners may also manage admins and owners.
+func (client *XmppClient) SetAffiliation(ctx context.Context, room jid.JID, user jid.JID, affiliation muc.Affiliation, reason string) error {
+	err := client.mucAdmin(ctx, stanza.SetIQ, room, mucAdminItem{
+		JID:         user.Bare().String(),
+		Affiliation: affiliation.String(),
+		Reason:      reason,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("unable to set affiliation of %s in %s to %s: %w",
+			user.Bare().String(), room.Bare().String(), affiliation.String(), err)
+	}
+	return nil
+}
+
+// Ban makes a user an outcast of the room, removing them and preventing them from joining again.
+func (client *XmppClient) Ban(ctx context.Context, room jid.JID, user jid.JID, reason string) error {
+	return client.SetAffiliation(ctx, room, user, muc.AffiliationOutcast, reason)
+}
+
+// GetAffiliations fetches everyone with the given affiliation in a room, such as the ban list for
+// muc.AffiliationOutcast or the member list for muc.AffiliationMember.
+func (client *XmppClient) GetAffiliations(ctx context.Context, room jid.JID, affiliation muc.Affiliation) ([]RoomAffiliation, error) {
+	resp := mucAdminQuery{}
+	err := client.mucAdmin(ctx, stanza.GetIQ, room, mucAdminItem{
+		Affiliation: affiliation.String(),
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch %s list of %s: %w", affiliation.String(), room.Bare().String(), err)
+	}
+
+	res := make([]RoomAffiliation, 0, len(resp.Items))
+	for _, item := range resp.Items {
+		j, err := jid.Parse(item.JID)
+		if err != nil {
+			continue
+		}
+		entry := RoomAffiliation{
+			JID:         j,
+			Affiliation: affiliation,
+			Nick:        item.Nick,
+			Reason:      item.Reason,
+		}
+		//rooms echo the affiliation, but trust the list we asked for if it is missing or unknown
+		_ = entry.Affiliation.UnmarshalXMLAttr(xml.Attr{Value: item.Affiliation})
+		res = append(res, entry)
+	}
+	return res, nil
+}
+
+// mucAdmin sends a muc#admin query with a single item to a room.
+// IQ errors are returned as stanza.Error, so they match the ErrMuc errors.
+func (client *XmppClient) mucAdmin(ctx context.Context, typ stanza.IQType, room jid.JID, item mucAdminItem, resp *mucAdminQuery) error {
+	payload, err := marshalTokens(mucAdminQuery{Items: []mucAdminItem{item}})
+	if err != nil {
+		return err
+	}
+	iq := stanza.IQ{
+		Type: typ,
+		To:   room.Bare(),
+	}
+	//a nil pointer in an interface would still be decoded into
+	if resp == nil {
+		return client.Session.UnmarshalIQElement(ctx, payload, iq, nil)
+	}
+	return client.Session.UnmarshalIQElement(ctx, payload, iq, resp)
+}
@@ -0,0 +1,223 @@
+package oasis_sdk
+
+// mucOwner.go implements creating, configuring and destroying rooms as per
+// https://xmpp.org/extensions/xep-0045.html#createroom and https://xmpp.org/extensions/xep-0045.html#destroyroom
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/muc"
+	"mellium.im/xmpp/stanza"
+)
+
+// ErrRoomExists is returned by CreateRoom when the room was already there, in which case we simply joined it
+var ErrRoomExists = errors.New("room already exists")
+
+// RoomWhois is who may see the real JIDs of occupants
+type RoomWhois string
+
+const (
+	// WhoisModerators makes the room semi-anonymous, only moderators see real JIDs
+	WhoisModerators RoomWhois = "moderators"
+	// WhoisAnyone makes the room non-anonymous
+	WhoisAnyone RoomWhois = "anyone"
+)
+
+// room configuration fields as per https://xmpp.org/extensions/xep-0045.html#registrar-formtype-owner
+const (
+	roomConfigName        = "muc#roomconfig_roomname"
+	roomConfigDescription = "muc#roomconfig_roomdesc"
+	roomConfigMembersOnly = "muc#roomconfig_membersonly"
+	roomConfigPersistent  = "muc#roomconfig_persistentroom"
+	roomConfigModerated   = "muc#roomconfig_moderatedroom"
+	roomConfigWhois       = "muc#roomconfig_whois"
+	roomConfigProtected   = "muc#roomconfig_passwordprotectedroom"
+	roomConfigSecret      = "muc#roomconfig_roomsecret"
+	roomConfigMaxUsers    = "muc#roomconfig_maxusers"
+	roomConfigArchiving   = "muc#roomconfig_enablearchiving"
+	roomConfigMam         = "mam" //used by ejabberd instead of the standard field
+)
+
+// RoomConfig is the typed subset of the room configuration form. Fields left nil keep the value
+// the room currently has, or the service default for a new room.
+type RoomConfig struct {
+	Name        *string
+	Description *string
+	MembersOnly *bool
+	Persistent  *bool
+	Moderated   *bool
+	Whois       *RoomWhois
+	Password    *string // empty string removes the password
+	Archiving   *bool   // whether the room stores its history in MAM
+	MaxUsers    *int    // 0 means no limit
+}
+
+type mucOwnerDestroy struct {
+	JID    string `xml:"jid,attr,omitempty"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+type mucOwnerQuery struct {
+	XMLName xml.Name         `xml:"http://jabber.org/protocol/muc#owner query"`
+	Destroy *mucOwnerDestroy `xml:"destroy"`
+}
+
+// CreateRoom creates a room by joining it with the nick of the bookmark, then configures it.
+// A nil config accepts the service defaults, creating an instant room.
+// If the room already exists it is joined as usual, and the returned error is ErrRoomExists.
+func (client *XmppClient) CreateRoom(ctx context.Context, bookmark bookmarks.Channel, config *RoomConfig) (*muc.Channel, error) {
+	//a new room has no history to fetch
+	noHistory := uint64(0)
+	ch, err := client.ConnectMuc(bookmark, MucLegacyHistoryConfig{MaxCount: &noHistory}, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !client.roomCreated(bookmark.JID) {
+		return ch, ErrRoomExists
+	}
+
+	//a new room stays locked until the owner submits a configuration
+	data := form.New()
+	if config != nil {
+		data, err = muc.GetConfig(ctx, bookmark.JID.Bare(), client.Session)
+		if err != nil {
+			return ch, fmt.Errorf("unable to fetch configuration of new room %s: %w", bookmark.JID.String(), err)
+		}
+		err = config.apply(data)
+		if err != nil {
+			return ch, err
+		}
+	}
+
+	err = client.submitRoomConfig(ctx, bookmark.JID, data)
+	if err != nil {
+		return ch, fmt.Errorf("unable to configure new room %s: %w", bookmark.JID.String(), err)
+	}
+	return ch, nil
+}
+
+// ConfigureRoom changes the configuration of a room we own.
+func (client *XmppClient) ConfigureRoom(ctx context.Context, room jid.JID, config RoomConfig) error {
+	data, err := muc.GetConfig(ctx, room.Bare(), client.Session)
+	if err != nil {
+		return fmt.Errorf("unable to fetch configuration of %s: %w", room.Bare().String(), err)
+	}
+	err = config.apply(data)
+	if err != nil {
+		return err
+	}
+	err = client.submitRoomConfig(ctx, room, data)
+	if err != nil {
+		return fmt.Errorf("unable to configure %s: %w", room.Bare().String(), err)
+	}
+	return nil
+}
+
+// GetRoomConfig fetches the full configuration form of a room we own, for fields RoomConfig doesn't cover.
+// Submit changes to it with SubmitRoomConfig.
+func (client *XmppClient) GetRoomConfig(ctx context.Context, room jid.JID) (*form.Data, error) {
+	return muc.GetConfig(ctx, room.Bare(), client.Session)
+}
+
+// SubmitRoomConfig submits a configuration form fetched with GetRoomConfig.
+func (client *XmppClient) SubmitRoomConfig(ctx context.Context, room jid.JID, data *form.Data) error {
+	return client.submitRoomConfig(ctx, room, data)
+}
+
+// DestroyRoom destroys a room we own, kicking everyone out. If alternate is given, occupants are
+// pointed to it as the new venue.
+func (client *XmppClient) DestroyRoom(ctx context.Context, room jid.JID, alternate *jid.JID, reason string) error {
+	destroy := &mucOwnerDestroy{Reason: reason}
+	if alternate != nil {
+		destroy.JID = alternate.Bare().String()
+	}
+	payload, err := marshalTokens(mucOwnerQuery{Destroy: destroy})
+	if err != nil {
+		return err
+	}
+	err = client.Session.UnmarshalIQElement(ctx, payload, stanza.IQ{
+		Type: stanza.SetIQ,
+		To:   room.Bare(),
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("unable to destroy %s: %w", room.Bare().String(), err)
+	}
+	return nil
+}
+
+// submitRoomConfig sends a configuration form to a room. Unlike muc.SetConfig it reports errors of the room.
+func (client *XmppClient) submitRoomConfig(ctx context.Context, room jid.JID, data *form.Data) error {
+	submission, _ := data.Submit()
+	return client.Session.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		submission,
+		xml.StartElement{Name: xml.Name{Space: muc.NSOwner, Local: "query"}},
+	), stanza.IQ{
+		Type: stanza.SetIQ,
+		To:   room.Bare(),
+	}, nil)
+}
+
+// apply sets the fields of the configuration form covered by the config.
+// Fails if the room doesn't offer a field that was asked for.
+func (config *RoomConfig) apply(data *form.Data) error {
+	var errs []error
+	set := func(field string, v any) {
+		ok, err := data.Set(field, v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("room config field %s: %w", field, err))
+		} else if !ok {
+			errs = append(errs, fmt.Errorf("room does not offer config field %s", field))
+		}
+	}
+
+	if config.Name != nil {
+		set(roomConfigName, *config.Name)
+	}
+	if config.Description != nil {
+		set(roomConfigDescription, *config.Description)
+	}
+	if config.MembersOnly != nil {
+		set(roomConfigMembersOnly, *config.MembersOnly)
+	}
+	if config.Persistent != nil {
+		set(roomConfigPersistent, *config.Persistent)
+	}
+	if config.Moderated != nil {
+		set(roomConfigModerated, *config.Moderated)
+	}
+	if config.Whois != nil {
+		set(roomConfigWhois, string(*config.Whois))
+	}
+	if config.Password != nil {
+		//not every service has the separate toggle
+		if _, ok := data.Raw(roomConfigProtected); ok {
+			set(roomConfigProtected, *config.Password != "")
+		}
+		set(roomConfigSecret, *config.Password)
+	}
+	if config.Archiving != nil {
+		if _, ok := data.Raw(roomConfigMam); ok {
+			set(roomConfigMam, *config.Archiving)
+		} else {
+			set(roomConfigArchiving, *config.Archiving)
+		}
+	}
+	if config.MaxUsers != nil {
+		//the form uses "none" for no limit
+		maxUsers := "none"
+		if *config.MaxUsers > 0 {
+			maxUsers = strconv.Itoa(*config.MaxUsers)
+		}
+		set(roomConfigMaxUsers, maxUsers)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,365 @@
+package oasis_sdk
+
+// occupants.go keeps the list of occupants of every room we are in, from the presences the room
+// sends as per https://xmpp.org/extensions/xep-0045.html#enter-pres
+
+import (
+	"encoding/xml"
+	"sort"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/muc"
+	"mellium.im/xmpp/stanza"
+)
+
+// muc#user status codes as per https://xmpp.org/registrar/mucstatus.html
+const (
+	mucStatusSelf          = 110
+	mucStatusCreated       = 201
+	mucStatusBanned        = 301
+	mucStatusNickChanged   = 303
+	mucStatusKicked        = 307
+	mucStatusAffiliation   = 321
+	mucStatusMembersOnly   = 322
+	mucStatusShutdown      = 332
+	mucStatusTechnicalKick = 333
+)
+
+// ------ mellium routing namespaces -------
+var mucUserNS = xml.Name{
+	Space: muc.NSUser,
+	Local: "x",
+}
+
+// OccupantEventType is what happened to an occupant
+type OccupantEventType int
+
+const (
+	// OccupantJoined is someone entering the room, including the initial roster when we join
+	OccupantJoined OccupantEventType = iota
+	// OccupantLeft is someone leaving the room on their own
+	OccupantLeft
+	// OccupantChanged is a change of presence, role or affiliation
+	OccupantChanged
+	// OccupantNickChanged is someone changing their nickname, OccupantEvent.OldNick holds the previous one
+	OccupantNickChanged
+	// OccupantKicked is someone being kicked by a moderator
+	OccupantKicked
+	// OccupantBanned is someone being banned by an admin
+	OccupantBanned
+	// OccupantRemoved is someone being removed for another reason, such as an affiliation change,
+	// the room becoming members-only, the room being destroyed or the service shutting down
+	OccupantRemoved
+)
+
+// Occupant is a participant of a room as we last saw them
+type Occupant struct {
+	Nick        string
+	JID         jid.JID  // occupant JID, room@service/nick
+	RealJID     *jid.JID // only known in non-anonymous rooms or when we are a moderator
+	OccupantID  string   // stable id across nick changes as per https://xmpp.org/extensions/xep-0421.html
+	Affiliation muc.Affiliation
+	Role        muc.Role
+	Show        PresenceShow
+	Status      string
+}
+
+// OccupantEvent is a change to the occupant list of a room
+type OccupantEvent struct {
+	Type     OccupantEventType
+	Room     jid.JID
+	Occupant Occupant
+	OldNick  string // set for OccupantNickChanged
+	Reason   string // optional reason given for a kick, ban or removal
+	Actor    string // optional nick of the moderator responsible for a kick or ban
+	Self     bool   // the event is about us
+	Created  bool   // we joined a room that was just created
+}
+
+// occupantState holds the occupant lists, keyed by bare room JID then nick
+type occupantState struct {
+	lock    sync.RWMutex
+	rooms   map[string]map[string]Occupant
+	created map[string]struct{} //rooms our last join created, which stay locked until configured
+}
+
+type mucStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+type mucActor struct {
+	Nick string `xml:"nick,attr"`
+}
+
+type mucDestroy struct {
+	JID    string `xml:"jid,attr"`
+	Reason string `xml:"reason"`
+}
+
+type mucUserPresenceItem struct {
+	muc.Item
+	Actor *mucActor `xml:"actor"`
+}
+
+// mucUserPresence is a presence from a room with everything needed to track the occupant
+type mucUserPresence struct {
+	stanza.Presence
+	Show       string      `xml:"show"`
+	Status     string      `xml:"status"`
+	OccupantId *OccupantId `xml:"urn:xmpp:occupant-id:0 occupant-id"`
+	X          struct {
+		Item    mucUserPresenceItem `xml:"item"`
+		Status  []mucStatus         `xml:"status"`
+		Destroy *mucDestroy         `xml:"destroy"`
+	} `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+func (p *mucUserPresence) hasStatus(code int) bool {
+	for _, status := range p.X.Status {
+		if status.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// SetOccupantHandler sets the handler function called when someone joins, leaves or changes in a room we are in.
+func (client *XmppClient) SetOccupantHandler(handler OccupantHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.OccupantHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// Occupants returns the current occupants of a room we are in, sorted by nick.
+func (client *XmppClient) Occupants(room jid.JID) []Occupant {
+	client.occupants.lock.RLock()
+	occupants := client.occupants.rooms[room.Bare().String()]
+	res := make([]Occupant, 0, len(occupants))
+	for _, occupant := range occupants {
+		res = append(res, occupant)
+	}
+	client.occupants.lock.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Nick < res[j].Nick
+	})
+	return res
+}
+
+// resetOccupants forgets what we know about the occupants of a room, before joining it again
+func (client *XmppClient) resetOccupants(room jid.JID) {
+	client.occupants.lock.Lock()
+	delete(client.occupants.rooms, room.Bare().String())
+	delete(client.occupants.created, room.Bare().String())
+	client.occupants.lock.Unlock()
+}
+
+// roomCreated reports whether joining the room created it, as per https://xmpp.org/extensions/xep-0045.html#createroom-general
+func (client *XmppClient) roomCreated(room jid.JID) bool {
+	client.occupants.lock.RLock()
+	defer client.occupants.lock.RUnlock()
+	_, ok := client.occupants.created[room.Bare().String()]
+	return ok
+}
+
+// internalHandleMucPresence tracks occupants from muc#user presences, then hands the presence to
+// mellium so joining and leaving rooms keeps working.
+func (client *XmppClient) internalHandleMucPresence(header stanza.Presence, t xmlstream.TokenReadEncoder) error {
+	//keep the stanza so it can be read twice
+	raw := rawXML{}
+	err := xml.NewTokenDecoder(t).Decode(&raw)
+	if err != nil {
+		return err
+	}
+	presence := mucUserPresence{}
+	err = raw.Decode(&presence)
+	if err != nil {
+		return err
+	}
+
+	event, ok := client.trackOccupant(&presence)
+
+	//unavailable presences of occupants don't reach internalHandleUnavailableCaps
+	if header.Type == stanza.UnavailablePresence {
+		client.forgetCaps(header.From)
+		if event.Self && event.Type != OccupantNickChanged {
+			client.forgetRoomCaps(header.From)
+		}
+	}
+
+	//mellium waits for our own unavailable presence only when we leave on purpose, handing it any
+	//other one would block the session forever
+	removedSelf := event.Self && header.Type == stanza.UnavailablePresence && event.Type != OccupantLeft
+	if !removedSelf {
+		err = client.MucClient.HandlePresence(header, struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: raw.TokenReader(),
+			Encoder:     t,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ok {
+		return nil
+	}
+	client.touchRoom(event.Room)
+	if event.Self {
+		client.selfOccupantEvent(event)
+	}
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.OccupantHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, event)
+	}
+	return nil
+}
+
+// selfOccupantEvent turns our own comings and goings in a room into room state events
+func (client *XmppClient) selfOccupantEvent(event OccupantEvent) {
+	state := RoomStateEvent{
+		Room:   event.Room,
+		Reason: event.Reason,
+	}
+	switch event.Type {
+	case OccupantJoined:
+		state.State = RoomJoined
+	case OccupantLeft:
+		state.State = RoomLeft
+	case OccupantKicked, OccupantBanned, OccupantRemoved:
+		state.State = RoomKicked
+	default:
+		return
+	}
+	if state.State != RoomJoined {
+		client.forgetRoom(event.Room)
+	}
+	client.emitRoomState(state)
+}
+
+// trackOccupant applies a muc#user presence to the occupant list of its room.
+// Returns false if nothing about the occupant changed.
+func (client *XmppClient) trackOccupant(p *mucUserPresence) (OccupantEvent, bool) {
+	room := p.From.Bare()
+	nick := p.From.Resourcepart()
+	event := OccupantEvent{
+		Room:    room,
+		Self:    p.hasStatus(mucStatusSelf),
+		Created: p.hasStatus(mucStatusCreated),
+		Reason:  p.X.Item.Reason,
+	}
+	if p.X.Item.Actor != nil {
+		event.Actor = p.X.Item.Actor.Nick
+	}
+
+	occupant := Occupant{
+		Nick:        nick,
+		JID:         p.From,
+		Affiliation: p.X.Item.Affiliation,
+		Role:        p.X.Item.Role,
+		Show:        parseShow(p.Show),
+		Status:      p.Status,
+	}
+	if !p.X.Item.JID.Equal(jid.JID{}) {
+		realJID := p.X.Item.JID
+		occupant.RealJID = &realJID
+	}
+	if p.OccupantId != nil {
+		occupant.OccupantID = p.OccupantId.Id
+	}
+
+	client.occupants.lock.Lock()
+	defer client.occupants.lock.Unlock()
+
+	if event.Self && event.Created {
+		client.occupants.created[room.String()] = struct{}{}
+	}
+
+	if p.Type == stanza.UnavailablePresence {
+		event.Type = departureType(p)
+		if p.X.Destroy != nil && p.X.Destroy.Reason != "" {
+			event.Reason = p.X.Destroy.Reason
+		}
+	}
+
+	occupants, ok := client.occupants.rooms[room.String()]
+	if !ok {
+		//a room we left sends nothing we need to keep
+		if p.Type == stanza.UnavailablePresence {
+			return event, false
+		}
+		occupants = make(map[string]Occupant)
+		client.occupants.rooms[room.String()] = occupants
+	}
+	previous, known := occupants[nick]
+
+	if p.Type == stanza.UnavailablePresence {
+		delete(occupants, nick)
+		event.Occupant = occupant
+
+		if p.hasStatus(mucStatusNickChanged) && p.X.Item.Nick != "" {
+			//the new nick is announced in the unavailable presence, the available one follows
+			newJID, err := room.WithResource(p.X.Item.Nick)
+			if err != nil {
+				return event, false
+			}
+			//the unavailable presence carries no show or status, keep what we had
+			if known {
+				occupant = previous
+			}
+			occupant.Nick = p.X.Item.Nick
+			occupant.JID = newJID
+			occupants[occupant.Nick] = occupant
+			event.Type = OccupantNickChanged
+			event.Occupant = occupant
+			event.OldNick = nick
+			return event, true
+		}
+
+		//once we are out of the room nobody else in it is known anymore
+		if event.Self {
+			delete(client.occupants.rooms, room.String())
+		}
+		return event, true
+	}
+
+	occupants[nick] = occupant
+	event.Occupant = occupant
+	if !known {
+		event.Type = OccupantJoined
+		return event, true
+	}
+	if previous.Affiliation == occupant.Affiliation && previous.Role == occupant.Role &&
+		previous.Show == occupant.Show && previous.Status == occupant.Status {
+		//the presence that completes a nick change, or a repeated one
+		return event, false
+	}
+	event.Type = OccupantChanged
+	return event, true
+}
+
+// departureType works out why an occupant sent unavailable presence from its status codes
+func departureType(p *mucUserPresence) OccupantEventType {
+	switch {
+	case p.hasStatus(mucStatusNickChanged):
+		return OccupantNickChanged
+	case p.hasStatus(mucStatusBanned):
+		return OccupantBanned
+	case p.hasStatus(mucStatusKicked):
+		return OccupantKicked
+	case p.X.Destroy != nil, p.hasStatus(mucStatusAffiliation), p.hasStatus(mucStatusMembersOnly),
+		p.hasStatus(mucStatusShutdown), p.hasStatus(mucStatusTechnicalKick):
+		return OccupantRemoved
+	default:
+		return OccupantLeft
+	}
+}
@@ -0,0 +1,74 @@
+package oasis_sdk
+
+// pep.go routes Personal Eventing Protocol notifications as per https://xmpp.org/extensions/xep-0163.html
+// to the feature that owns the node.
+
+import (
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// NSPubSubEvent is the namespace of pubsub event notifications
+const NSPubSubEvent = "http://jabber.org/protocol/pubsub#event"
+
+// ------ mellium routing namespaces -------
+var pepEventNS = xml.Name{
+	Space: NSPubSubEvent,
+	Local: "event",
+}
+
+// pepItem is a published item, with its payload kept raw until the node's handler decodes it
+type pepItem struct {
+	ID      string `xml:"id,attr"`
+	Payload rawXML `xml:",any"`
+}
+
+type pepRetract struct {
+	ID string `xml:"id,attr"`
+}
+
+type pepItems struct {
+	Node    string       `xml:"node,attr"`
+	Items   []pepItem    `xml:"item"`
+	Retract []pepRetract `xml:"retract"`
+}
+
+type pepEventMessage struct {
+	stanza.Message
+	Event struct {
+		Items pepItems `xml:"items"`
+	} `xml:"http://jabber.org/protocol/pubsub#event event"`
+}
+
+// internalHandlePEPEvent decodes a pubsub event and hands it to the feature that owns the node.
+func (client *XmppClient) internalHandlePEPEvent(header stanza.Message, t xmlstream.TokenReadEncoder) error {
+	d := xml.NewTokenDecoder(t)
+	msg := pepEventMessage{}
+	err := d.Decode(&msg)
+	if err != nil {
+		return err
+	}
+
+	//PEP notifications always come from a bare JID
+	from := header.From.Bare()
+	if header.From.Equal(jid.JID{}) {
+		from = client.JID.Bare()
+	}
+
+	items := msg.Event.Items
+	switch items.Node {
+	case nsAvatarMetadata:
+		client.internalHandleAvatarMetadata(from, items.Items)
+	case nsNick:
+		client.internalHandleNick(from, items.Items)
+	case bookmarks.NS:
+		client.internalHandleBookmarkEvent(from, items)
+	case nsLegacyBookmarks:
+		client.internalHandleLegacyBookmarkEvent(from, items.Items)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package oasis_sdk
 
 import (
+	"context"
 	"encoding/xml"
 
 	"mellium.im/xmlstream"
@@ -33,6 +34,33 @@ type UserPresence struct {
 	Header    stanza.Presence
 }
 
+// parseShow converts the show element of a presence into a PresenceShow
+func parseShow(show string) PresenceShow {
+	switch show {
+	case "chat":
+		return PresenceShowChat
+	case "away":
+		return PresenceShowAway
+	case "xa":
+		return PresenceShowXA
+	case "dnd":
+		return PresenceShowDND
+	case "":
+		return PresenceShowAvailable
+	default:
+		return PresenceShowUnknown
+	}
+}
+
+// sendSelfPresence broadcasts our available presence, including our caps and avatar hash.
+func (client *XmppClient) sendSelfPresence(ctx context.Context) error {
+	payload := client.capsPayload()
+	if update := client.vcardUpdatePayload(); update != nil {
+		payload = xmlstream.MultiReader(payload, update)
+	}
+	return client.Session.Send(ctx, stanza.Presence{Type: stanza.AvailablePresence}.Wrap(payload))
+}
+
 func (client *XmppClient) internalHandleVanityPresence(header stanza.Presence, t xmlstream.TokenReadEncoder) error {
 	d := xml.NewTokenDecoder(t)
 	body := PresenceBody{}
@@ -50,19 +78,13 @@ func (client *XmppClient) internalHandleVanityPresence(header stanza.Presence, t
 		Body: body,
 		Header: header,
 	}
-	switch presence.Show {
-	case "chat":
-		p.Indicator = PresenceShowChat
-	case "away":
-		p.Indicator = PresenceShowAway
-	case "xa":
-		p.Indicator = PresenceShowXA
-	case "dnd":
-		p.Indicator = PresenceShowDND
-	case "":
-		p.Indicator = PresenceShowAvailable
-	default:
-		p.Indicator = PresenceShowUnknown
+	p.Indicator = parseShow(presence.Show)
+
+	//avatars of muc occupants are per occupant, everyone else per account
+	if body.MUCUser != nil {
+		client.internalHandleVCardAvatar(header.From, body.VCardUpdate)
+	} else {
+		client.internalHandleVCardAvatar(header.From.Bare(), body.VCardUpdate)
 	}
 
 	//get handler with lock
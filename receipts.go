@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -67,7 +68,7 @@ func (client *XmppClient) internalHandleReadReceipt(header stanza.Message, t xml
 func (client *XmppClient) MarkAsDelivered(orignalMSG *XMPPChatMessage) {
 	msg := DeliveryReceiptResponse{
 		Message: stanza.Message{
-			To:   orignalMSG.From.Bare(),
+			To:   receiptTo(orignalMSG),
 			Type: orignalMSG.Type,
 		},
 		Received: DeliveryReceipt{
@@ -102,7 +103,7 @@ func (client *XmppClient) MarkAsRead(orignalMSG *XMPPChatMessage) error {
 	//craft event
 	msg := ReadReceiptResponse{
 		Message: stanza.Message{
-			To:   orignalMSG.From.Bare(),
+			To:   receiptTo(orignalMSG),
 			Type: orignalMSG.Type,
 		},
 		Displayed: ReadReceipt{
@@ -113,3 +114,11 @@ func (client *XmppClient) MarkAsRead(orignalMSG *XMPPChatMessage) error {
 	//send
 	return client.Session.Encode(client.Ctx, msg)
 }
+
+// receiptTo is where a receipt for a message goes, the occupant for private messages in a room and the bare JID otherwise
+func receiptTo(orignalMSG *XMPPChatMessage) jid.JID {
+	if orignalMSG.IsMucPrivate() {
+		return orignalMSG.From
+	}
+	return orignalMSG.From.Bare()
+}
@@ -0,0 +1,110 @@
+package oasis_sdk
+
+// roomSettings.go keeps per-room settings of Oasis apps in a bookmark extension as per
+// https://xmpp.org/extensions/xep-0402.html#extensions, so they follow the user across devices.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+
+	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/jid"
+)
+
+// NSRoomSettings is the namespace of the Oasis room settings bookmark extension
+const NSRoomSettings = "https://github.com/sunglocto/oasis-sdk#room-settings"
+
+// NotifyLevel is which messages of a room should notify
+type NotifyLevel string
+
+const (
+	// NotifyDefault leaves it to the app
+	NotifyDefault NotifyLevel = ""
+	// NotifyAll notifies for every message
+	NotifyAll NotifyLevel = "all"
+	// NotifyMentions notifies only when we are mentioned
+	NotifyMentions NotifyLevel = "mentions"
+	// NotifyNone never notifies
+	NotifyNone NotifyLevel = "none"
+)
+
+// RoomSettings are the per-room settings of Oasis apps
+type RoomSettings struct {
+	XMLName  xml.Name    `xml:"https://github.com/sunglocto/oasis-sdk#room-settings settings"`
+	Muted    bool        `xml:"muted,attr,omitempty"`
+	Pinned   bool        `xml:"pinned,attr,omitempty"`
+	Notify   NotifyLevel `xml:"notify,attr,omitempty"`
+	LastRead string      `xml:"last-read,omitempty"` // stanza-id of the last message read
+}
+
+// GetRoomSettings reads the Oasis settings stored in a bookmark. Returns false if it has none.
+func GetRoomSettings(bookmark bookmarks.Channel) (RoomSettings, bool) {
+	for _, extension := range bookmarkExtensions(bookmark) {
+		if extension.Name().Space != NSRoomSettings {
+			continue
+		}
+		settings := RoomSettings{}
+		if extension.Decode(&settings) != nil {
+			continue
+		}
+		return settings, true
+	}
+	return RoomSettings{}, false
+}
+
+// WithRoomSettings returns the bookmark with its Oasis settings replaced, keeping the extensions
+// of other clients. Publish the result with PublishBookmark.
+func WithRoomSettings(bookmark bookmarks.Channel, settings RoomSettings) (bookmarks.Channel, error) {
+	data, err := xml.Marshal(settings)
+	if err != nil {
+		return bookmark, err
+	}
+	own := rawXML{}
+	err = xml.Unmarshal(data, &own)
+	if err != nil {
+		return bookmark, err
+	}
+
+	//replace ours in place, so the extensions of other clients keep their order
+	extensions := bookmarkExtensions(bookmark)
+	replaced := false
+	for i, extension := range extensions {
+		if extension.Name().Space == NSRoomSettings {
+			extensions[i] = own
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		extensions = append(extensions, own)
+	}
+	setBookmarkExtensions(&bookmark, extensions)
+	return bookmark, nil
+}
+
+// RoomSettings returns the Oasis settings of a bookmarked room from the bookmark cache.
+func (client *XmppClient) RoomSettings(room jid.JID) (RoomSettings, bool) {
+	client.bookmarkLock.RLock()
+	bookmark, ok := client.bookmarks[room.Bare().String()]
+	client.bookmarkLock.RUnlock()
+	if !ok {
+		return RoomSettings{}, false
+	}
+	return GetRoomSettings(bookmark)
+}
+
+// SetRoomSettings stores the Oasis settings of a bookmarked room and publishes the bookmark.
+func (client *XmppClient) SetRoomSettings(ctx context.Context, room jid.JID, settings RoomSettings) error {
+	client.bookmarkLock.RLock()
+	bookmark, ok := client.bookmarks[room.Bare().String()]
+	client.bookmarkLock.RUnlock()
+	if !ok {
+		return errors.New("bookmark not found")
+	}
+	bookmark, err := WithRoomSettings(bookmark, settings)
+	if err != nil {
+		return err
+	}
+	return client.PublishBookmark(bookmark, ctx)
+}
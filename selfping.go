@@ -0,0 +1,327 @@
+package oasis_sdk
+
+// selfping.go checks that we are still in the rooms we think we are in, by pinging our own occupant JID
+// as per https://xmpp.org/extensions/xep-0410.html, and rejoins the ones that dropped us.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/ping"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	// how often rooms are checked
+	mucSelfPingInterval = time.Minute
+	// rooms that sent us anything more recently than this are known to still have us
+	mucSelfPingIdle = 5 * time.Minute
+	// how long to wait for the room to answer before considering us gone
+	mucSelfPingTimeout = 30 * time.Second
+	// how long a rejoin may take, including fetching the history we missed
+	mucRejoinTimeout = 2 * time.Minute
+)
+
+// ------ mellium routing namespaces -------
+var mamResultNS = xml.Name{
+	Space: nsMAM,
+	Local: "result",
+}
+
+// RoomState is whether we are in a room
+type RoomState int
+
+const (
+	// RoomJoined is us entering a room, including after a rejoin
+	RoomJoined RoomState = iota
+	// RoomRejoining is us noticing the room dropped us, and joining it again
+	RoomRejoining
+	// RoomLeft is us leaving a room, on our own or because a rejoin failed
+	RoomLeft
+	// RoomKicked is us being kicked, banned or otherwise removed from a room
+	RoomKicked
+)
+
+// RoomStateEvent is a change of whether we are in a room
+type RoomStateEvent struct {
+	Room   jid.JID
+	State  RoomState
+	Reason string // optional reason given by the room for a kick, ban or removal
+	Err    error  // why a rejoin failed, for RoomLeft
+}
+
+// mucJoin is what we joined a room with, so we can join it the same way again
+type mucJoin struct {
+	bookmark     bookmarks.Channel
+	histCFG      MucLegacyHistoryConfig
+	lastActivity time.Time // last time the room sent us anything
+	rejoining    bool
+}
+
+// mucJoinState holds the joins of the rooms we are in, keyed by bare room JID
+type mucJoinState struct {
+	lock  sync.Mutex
+	joins map[string]*mucJoin
+}
+
+// mamResultMessage is a message from an archive answering a query as per https://xmpp.org/extensions/xep-0313.html#results
+type mamResultMessage struct {
+	stanza.Message
+	Result struct {
+		QueryID   string `xml:"queryid,attr"`
+		ID        string `xml:"id,attr"`
+		Forwarded struct {
+			Delay   *delay.Delay    `xml:"urn:xmpp:delay delay"`
+			Message XMPPChatMessage `xml:"jabber:client message"`
+		} `xml:"urn:xmpp:forward:0 forwarded"`
+	} `xml:"urn:xmpp:mam:2 result"`
+}
+
+// SetRoomStateHandler sets the handler function called when we join, leave, get kicked from
+// or are rejoining a room.
+func (client *XmppClient) SetRoomStateHandler(handler RoomStateHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.RoomStateHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// rememberJoin records how we joined a room
+func (client *XmppClient) rememberJoin(bookmark bookmarks.Channel, histCFG MucLegacyHistoryConfig) {
+	client.mucJoins.lock.Lock()
+	defer client.mucJoins.lock.Unlock()
+	room := bookmark.JID.Bare().String()
+	join, ok := client.mucJoins.joins[room]
+	if ok && join.rejoining {
+		//a rejoin keeps what the room was originally joined with
+		join.lastActivity = time.Now()
+		return
+	}
+	client.mucJoins.joins[room] = &mucJoin{
+		bookmark:     bookmark,
+		histCFG:      histCFG,
+		lastActivity: time.Now(),
+	}
+}
+
+// setJoinNick keeps the nick of a join in sync after a nick change
+func (client *XmppClient) setJoinNick(room jid.JID, nick string) {
+	client.mucJoins.lock.Lock()
+	defer client.mucJoins.lock.Unlock()
+	if join, ok := client.mucJoins.joins[room.Bare().String()]; ok {
+		join.bookmark.Nick = nick
+	}
+}
+
+// touchRoom notes that a room sent us something, which means we are still in it
+func (client *XmppClient) touchRoom(room jid.JID) {
+	client.mucJoins.lock.Lock()
+	defer client.mucJoins.lock.Unlock()
+	if join, ok := client.mucJoins.joins[room.Bare().String()]; ok {
+		join.lastActivity = time.Now()
+	}
+}
+
+// forgetRoom drops a room we are no longer in
+func (client *XmppClient) forgetRoom(room jid.JID) {
+	room = room.Bare()
+
+	client.mucLock.Lock()
+	delete(client.MucChannels, room.String())
+	delete(client.mucSubjects, room.String())
+	client.mucLock.Unlock()
+
+	client.mucJoins.lock.Lock()
+	delete(client.mucJoins.joins, room.String())
+	client.mucJoins.lock.Unlock()
+}
+
+// emitRoomState hands a room state change to the RoomStateHandler
+func (client *XmppClient) emitRoomState(event RoomStateEvent) {
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.RoomStateHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, event)
+	}
+}
+
+// mucSelfPingLoop pings every idle room we are in until the client stops
+func (client *XmppClient) mucSelfPingLoop() {
+	ticker := time.NewTicker(mucSelfPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-client.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		//rooms that are busy prove we are in them, so only ping the quiet ones
+		var idle []jid.JID
+		client.mucJoins.lock.Lock()
+		for _, join := range client.mucJoins.joins {
+			if !join.rejoining && time.Since(join.lastActivity) >= mucSelfPingIdle {
+				idle = append(idle, join.bookmark.JID.Bare())
+			}
+		}
+		client.mucJoins.lock.Unlock()
+
+		for _, room := range idle {
+			go client.selfPing(room)
+		}
+	}
+}
+
+// selfPing pings our occupant JID in a room, rejoining it if the room no longer knows us
+func (client *XmppClient) selfPing(room jid.JID) {
+	client.mucLock.RLock()
+	ch, ok := client.MucChannels[room.String()]
+	client.mucLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(client.Ctx, mucSelfPingTimeout)
+	err := ping.Send(ctx, client.Session, ch.Me())
+	cancel()
+
+	if stillJoined(err) {
+		client.touchRoom(room)
+		return
+	}
+	//shutting down is not the room dropping us
+	if client.Ctx.Err() != nil {
+		return
+	}
+	client.rejoinMuc(room)
+}
+
+// stillJoined interprets the answer to a self-ping as per https://xmpp.org/extensions/xep-0410.html#performing
+func stillJoined(err error) bool {
+	//the room passed the ping to our own client, or answered it for us
+	if err == nil {
+		return true
+	}
+	//the room knows us, it just can't forward the ping to our client. service-unavailable is
+	//already reported as success by mellium
+	return errors.Is(err, stanza.Error{Condition: stanza.FeatureNotImplemented})
+}
+
+// rejoinMuc joins a room that dropped us again, with the bookmark and history config of the original join.
+// Rooms with an archive are asked for the messages we missed, others send legacy history since then.
+func (client *XmppClient) rejoinMuc(room jid.JID) {
+	client.mucJoins.lock.Lock()
+	join, ok := client.mucJoins.joins[room.String()]
+	if !ok || join.rejoining {
+		client.mucJoins.lock.Unlock()
+		return
+	}
+	join.rejoining = true
+	bookmark := join.bookmark
+	histCFG := join.histCFG
+	since := join.lastActivity
+	client.mucJoins.lock.Unlock()
+
+	client.emitRoomState(RoomStateEvent{
+		Room:  room,
+		State: RoomRejoining,
+	})
+
+	ctx, cancel := context.WithTimeout(client.Ctx, mucRejoinTimeout)
+	defer cancel()
+
+	//a room with an archive fills the gap more reliably than legacy history
+	useMAM := false
+	info, err := client.GetDiscoInfo(ctx, room, "")
+	if err == nil {
+		useMAM = hasFeature(info, nsMAM)
+	}
+	if useMAM {
+		noHistory := uint64(0)
+		histCFG = MucLegacyHistoryConfig{MaxCount: &noHistory}
+	} else if histCFG.MaxCount == nil || *histCFG.MaxCount > 0 {
+		histCFG.Since = &since
+	}
+
+	_, err = client.ConnectMuc(bookmark, histCFG, ctx)
+
+	client.mucJoins.lock.Lock()
+	join.rejoining = false
+	client.mucJoins.lock.Unlock()
+
+	if err != nil {
+		//the room refused us, so we are out for good. Anything else may be temporary and is
+		//retried on the next ping
+		if stanzaErr := (stanza.Error{}); errors.As(err, &stanzaErr) {
+			client.forgetRoom(room)
+			client.emitRoomState(RoomStateEvent{
+				Room:  room,
+				State: RoomLeft,
+				Err:   err,
+			})
+			return
+		}
+		fmt.Printf("Could not rejoin %s: %v\n", room.String(), err)
+		return
+	}
+
+	if useMAM {
+		_, err = history.Fetch(ctx, history.Query{Start: since}, room, client.Session)
+		if err != nil {
+			fmt.Printf("Could not fetch missed history of %s: %v\n", room.String(), err)
+		}
+	}
+}
+
+// internalHandleMamResult delivers messages a room archive sends in answer to our queries to the GroupMessageHandler
+func (client *XmppClient) internalHandleMamResult(header stanza.Message, t xmlstream.TokenReadEncoder) error {
+	msg := mamResultMessage{}
+	err := xml.NewTokenDecoder(t).Decode(&msg)
+	if err != nil {
+		return err
+	}
+
+	//only rooms we are in may send us their archive, and only their own messages
+	room := header.From.Bare()
+	inner := &msg.Result.Forwarded.Message
+	if room.Equal(jid.JID{}) || !inner.From.Bare().Equal(room) || inner.Type != stanza.GroupChatMessage {
+		return nil
+	}
+
+	client.mucLock.RLock()
+	ch := client.MucChannels[room.String()]
+	client.mucLock.RUnlock()
+	if ch == nil {
+		return nil
+	}
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.GroupMessageHandler
+	client.handlers.Lock.Unlock()
+
+	if handler == nil {
+		return nil
+	}
+
+	//the archive puts the original time on the forward
+	if inner.Delay == nil {
+		inner.Delay = msg.Result.Forwarded.Delay
+	}
+	inner.ParseReply()
+	inner.ParseAttachments()
+
+	handler(client, ch, inner)
+	return nil
+}
@@ -0,0 +1,235 @@
+package oasis_sdk
+
+// thumbnail.go makes previews of uploaded images: a small thumbnail as per https://xmpp.org/extensions/xep-0264.html
+// and a blurhash as per https://github.com/woltapp/blurhash, which clients show until the full file has loaded.
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+	"net/url"
+	"strings"
+)
+
+const (
+	// thumbnailSize is the largest side of thumbnails, they are sent inline so must stay small
+	thumbnailSize    = 128
+	thumbnailQuality = 60
+	// blurhashSize is the largest side of the image the blurhash is computed from, more detail is lost anyway
+	blurhashSize = 32
+	// previewMaxPixels is the largest image we decode for a preview, to not run out of memory on huge images
+	previewMaxPixels = 40_000_000
+	// mediaTypeBlurhash marks thumbnails that hold a blurhash instead of an image, as Cheogram and Dino do
+	mediaTypeBlurhash  = "image/blurhash"
+	blurhashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+// Thumbnail is a preview of an image or video as per https://xmpp.org/extensions/xep-0264.html
+type Thumbnail struct {
+	XMLName   xml.Name `xml:"urn:xmpp:thumbs:1 thumbnail"`
+	URI       string   `xml:"uri,attr"` //usually a data: URI holding the image
+	MediaType string   `xml:"media-type,attr,omitempty"`
+	Width     int      `xml:"width,attr,omitempty"`
+	Height    int      `xml:"height,attr,omitempty"`
+}
+
+// Data returns the image of a thumbnail sent inline as a data: URI, or false if it is stored elsewhere.
+func (thumbnail Thumbnail) Data() ([]byte, bool) {
+	rest, ok := strings.CutPrefix(thumbnail.URI, "data:")
+	if !ok {
+		return nil, false
+	}
+	header, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return nil, false
+	}
+	if strings.HasSuffix(header, ";base64") {
+		data, err := base64.StdEncoding.DecodeString(payload)
+		return data, err == nil
+	}
+	data, err := url.PathUnescape(payload)
+	return []byte(data), err == nil
+}
+
+// blurhashThumbnail wraps a blurhash of an image of the given size as a thumbnail
+func blurhashThumbnail(hash string, width int, height int) Thumbnail {
+	return Thumbnail{
+		URI:       "data:" + mediaTypeBlurhash + "," + url.PathEscape(hash),
+		MediaType: mediaTypeBlurhash,
+		Width:     width,
+		Height:    height,
+	}
+}
+
+// imagePreview decodes an image as it streams past, and makes its thumbnail and blurhash once it is complete
+type imagePreview struct {
+	pipe      *io.PipeWriter
+	done      chan struct{}
+	thumbnail *Thumbnail
+	blurhash  string
+}
+
+func newImagePreview() *imagePreview {
+	r, w := io.Pipe()
+	preview := &imagePreview{
+		pipe: w,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(preview.done)
+		//keep reading whatever happens, the upload must never wait on us
+		defer io.Copy(io.Discard, r)
+
+		//check the size before decoding, the header is replayed to the decoder
+		head := &bytes.Buffer{}
+		config, _, err := image.DecodeConfig(io.TeeReader(r, head))
+		if err != nil || config.Width*config.Height > previewMaxPixels {
+			return
+		}
+		img, _, err := image.Decode(io.MultiReader(head, r))
+		if err != nil {
+			return
+		}
+		preview.thumbnail, preview.blurhash = makePreview(img)
+	}()
+	return preview
+}
+
+// Write implements io.Writer, feeding the decoder
+func (preview *imagePreview) Write(p []byte) (int, error) {
+	_, _ = preview.pipe.Write(p)
+	return len(p), nil
+}
+
+// close ends the stream and waits for the preview. A failed upload stops the decoder early.
+func (preview *imagePreview) close(err error) {
+	_ = preview.pipe.CloseWithError(err)
+	<-preview.done
+}
+
+// makePreview scales img down to a JPEG thumbnail and computes its blurhash
+func makePreview(img image.Image) (*Thumbnail, string) {
+	scaled := scaleDown(img, thumbnailSize)
+
+	//JPEG has no transparency, so put the image on white
+	bounds := scaled.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), scaled, bounds.Min, draw.Over)
+
+	buf := bytes.Buffer{}
+	err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: thumbnailQuality})
+	if err != nil {
+		return nil, ""
+	}
+	thumbnail := &Thumbnail{
+		URI:       "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+		MediaType: "image/jpeg",
+		Width:     flat.Bounds().Dx(),
+		Height:    flat.Bounds().Dy(),
+	}
+	return thumbnail, blurhash(scaleDown(flat, blurhashSize))
+}
+
+// blurhash encodes img as per https://github.com/woltapp/blurhash/blob/master/Algorithm.md
+// with 4 components along the long side and 3 along the short one.
+func blurhash(img image.Image) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return ""
+	}
+	cx, cy := 4, 3
+	if height > width {
+		cx, cy = 3, 4
+	}
+
+	//linear colors of every pixel, looked up many times below
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			linear[y*width+x] = [3]float64{srgbToLinear(r >> 8), srgbToLinear(g >> 8), srgbToLinear(b >> 8)}
+		}
+	}
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) * basisY
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	hash := strings.Builder{}
+	hash.WriteString(encode83((cx-1)+(cy-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximum := 0.0
+	for _, factor := range ac {
+		maximum = max(maximum, math.Abs(factor[0]), math.Abs(factor[1]), math.Abs(factor[2]))
+	}
+	quantisedMax := int(max(0, min(82, math.Floor(maximum*166-0.5))))
+	maximumValue := float64(quantisedMax+1) / 166
+	hash.WriteString(encode83(quantisedMax, 1))
+
+	hash.WriteString(encode83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, factor := range ac {
+		quantise := func(v float64) int {
+			return int(max(0, min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encode83(quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2))
+	}
+	return hash.String()
+}
+
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := max(0, min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value float64, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// encode83 writes value as length base 83 digits
+func encode83(value int, length int) string {
+	res := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		res[i] = blurhashCharacters[value%83]
+		value /= 83
+	}
+	return string(res)
+}
@@ -1,13 +1,17 @@
 package oasis_sdk
 
 import (
+	"bytes"
 	"context"
 	"encoding/xml"
+	"io"
 	"sync"
 	"sync/atomic"
 
+	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/bookmarks"
+	"mellium.im/xmpp/delay"
 	"mellium.im/xmpp/disco"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/muc"
@@ -23,6 +27,8 @@ type LoginInfo struct {
 	DisplayName string `json:"DisplayName"`
 	TLSoff      bool   `json:"NoTLS"`
 	StartTLS    bool   `json:"StartTLS"`
+	CacheDir    string `json:"CacheDir"`   //optional, directory for persistent caches such as caps
+	ClientName  string `json:"ClientName"` //optional, name of our client identity in service discovery
 }
 
 type FallbackBody struct {
@@ -113,10 +119,17 @@ type ChatMessageBody struct {
 	ComposingChatState *ComposingChatstate     `xml:"composing"`
 	PausedChatState    *PausedChatstate        `xml:"paused"`
 	OutOfBandMedia     *OutOfBandMedia         `xml:"jabber:x:oob x"`
+	FileSharing        []FileSharing           `xml:"urn:xmpp:sfs:0 file-sharing"`
+	FileSources        []FileSources           `xml:"urn:xmpp:sfs:0 sources"` //sources of files shared in the message AttachTo points at
+	AttachTo           *AttachTo               `xml:"urn:xmpp:message-attaching:1 attach-to"`
+	References         []Reference             `xml:"urn:xmpp:reference:0 reference"`
+	MUCUser            *MUCUser                `xml:"http://jabber.org/protocol/muc#user x"` //marks private messages in a room
+	Delay              *delay.Delay            `xml:"urn:xmpp:delay delay"`                  //original time of history and offline messages
 	Unknown            []UnknownElement        `xml:",any"`
 	FallbacksParsed    bool                    `xml:"-"`
 	CleanedBody        *string                 `xml:"-"`
 	ReplyFallbackText  *string                 `xml:"-"`
+	Attachments        []Attachment            `xml:"-"` //files shared in the message, filled by ParseAttachments
 }
 
 func (chatMsg *ChatMessageBody) RequestingDeliveryReceipt() bool {
@@ -127,6 +140,11 @@ func (chatMsg *ChatMessageBody) RequestingReadReceipt() bool {
 	return chatMsg.Markable != nil
 }
 
+// IsMucPrivate reports whether the message is a private message with an occupant of a room
+func (chatMsg *ChatMessageBody) IsMucPrivate() bool {
+	return chatMsg.MUCUser != nil
+}
+
 /*
 XMPPChatMessage struct is a representation of the stanza such that it's contextual items
 such as room, as well as abstract methods such as .reply()
@@ -158,6 +176,7 @@ type MUCUser struct {
 
 type MUCUserItem struct {
 	JID         string `xml:"jid,attr"`
+	Nick        string `xml:"nick,attr"`
 	Affiliation string `xml:"affiliation,attr"`
 	Role        string `xml:"role,attr"`
 }
@@ -169,7 +188,8 @@ type MUCUserStatus struct {
 type PresenceBody struct {
 	Show        string       `xml:"show"`
 	Status      string       `xml:"status"`
-	Caps        *disco.Caps  `xml:"c"`
+	Caps        *disco.Caps  `xml:"http://jabber.org/protocol/caps c"`
+	ECaps2      *ECaps2      `xml:"urn:xmpp:caps c"`
 	VCardUpdate *VCardUpdate `xml:"vcard-temp:x:update x"`
 	OccupantId  *OccupantId  `xml:"occupant-id"`
 	MUCUser     *MUCUser     `xml:"http://jabber.org/protocol/muc#user x"`
@@ -183,6 +203,7 @@ type Presence struct {
 type HttpUploadComponent struct {
 	Jid         jid.JID
 	MaxFileSize int
+	Namespace   string // upload namespace the service speaks, older services use the namespaces of earlier versions
 }
 
 type ChatMessageHandler func(client *XmppClient, message *XMPPChatMessage)
@@ -190,9 +211,19 @@ type GroupChatMessageHandler func(client *XmppClient, channel *muc.Channel, mess
 type ChatstateHandler func(client *XmppClient, from jid.JID, state ChatState)
 type DeliveryReceiptHandler func(client *XmppClient, from jid.JID, id string)
 type ReadReceiptHandler func(client *XmppClient, from jid.JID, id string)
-type BookmarkHandler func(client *XmppClient, bookmark bookmarks.Channel)
+type BookmarkHandler func(client *XmppClient, event BookmarkEvent)
 
 type PresenceHandler func(client *XmppClient, from jid.JID, p UserPresence)
+type AvatarHandler func(client *XmppClient, from jid.JID, hash string)
+type NicknameHandler func(client *XmppClient, from jid.JID, nick string)
+type DiscoveryFinishedHandler func(client *XmppClient, caps ServerCapabilities, err error)
+type BlockListHandler func(client *XmppClient, blocked []jid.JID, unblocked []jid.JID)
+type OccupantHandler func(client *XmppClient, event OccupantEvent)
+type InvitationHandler func(client *XmppClient, invite RoomInvitation)
+type MucPrivateMessageHandler func(client *XmppClient, channel *muc.Channel, message *XMPPChatMessage)
+type SubjectHandler func(client *XmppClient, room jid.JID, subject RoomSubject)
+type RoomStateHandler func(client *XmppClient, event RoomStateEvent)
+type AutojoinErrorHandler func(client *XmppClient, bookmark bookmarks.Channel, err error)
 
 type handlerMap struct {
 	Lock                   sync.Mutex
@@ -203,6 +234,17 @@ type handlerMap struct {
 	ReadReceiptHandler     ReadReceiptHandler
 	BookmarkHandler        BookmarkHandler
 	PresenceHandler        PresenceHandler
+	AvatarHandler          AvatarHandler
+	NicknameHandler        NicknameHandler
+
+	DiscoveryFinishedHandler DiscoveryFinishedHandler
+	BlockListHandler         BlockListHandler
+	OccupantHandler          OccupantHandler
+	InvitationHandler        InvitationHandler
+	MucPrivateMessageHandler MucPrivateMessageHandler
+	SubjectHandler           SubjectHandler
+	RoomStateHandler         RoomStateHandler
+	AutojoinErrorHandler     AutojoinErrorHandler
 }
 
 // XmppClient is the end xmpp client object from which everything else works around
@@ -215,14 +257,31 @@ type XmppClient struct {
 	Server              *string
 	Session             *xmpp.Session
 	Multiplexer         *mux.ServeMux
-	AutojoinLevel       atomic.Int32
+	AutojoinLevel       atomic.Int32           //which bookmarks to join on connect, AutojoinBookmarked by default
+	AutojoinHistory     MucLegacyHistoryConfig //history to ask for when autojoining, set before Connect
+	FilterBlocked       atomic.Bool            //drop messages from blocked JIDs before they reach the handlers, on by default
 	HttpUploadComponent *HttpUploadComponent
+	UploadImages        *ImageOptions //how to clean up uploaded images by default, including through UploadFile. Nil uploads them as they are
 	MucClient           *muc.Client
 	MucChannels         map[string]*muc.Channel
+	mucSubjects         map[string]RoomSubject
+	mucJoins            mucJoinState
 	mucLock             sync.RWMutex
 	handlers            handlerMap
 	bookmarks           map[string]bookmarks.Channel
 	bookmarkLock        sync.RWMutex
+	legacyBookmarkLock  sync.Mutex //serializes read-modify-write of legacy bookmark storage
+	fileReplay          fileReplay
+	caps                capsCache
+	discoResponder      discoResponderState
+	discoCache          discoCache
+	serverCaps          ServerCapabilities
+	serverCapsLock      sync.RWMutex
+	discoveryDone       chan struct{}
+	discoveryLock       sync.Mutex //serializes discovery runs, so each closes its own discoveryDone
+	avatars             avatarState
+	blockList           blockListState
+	occupants           occupantState
 }
 
 // AwaitStart locks and unlocks the isStarted lock to safely await the client being started before executing things.
@@ -230,3 +289,98 @@ func (client *XmppClient) AwaitStart() {
 	client.isStartedLock.Lock()
 	defer client.isStartedLock.Unlock()
 }
+
+// rawXML keeps an element as a list of tokens, so it can be decoded into a typed struct later
+// or written back out unchanged.
+type rawXML struct {
+	tokens []xml.Token
+}
+
+// UnmarshalXML implements xml.Unmarshaler by recording every token of the element.
+func (raw *rawXML) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	raw.tokens = append(raw.tokens[:0], stripXmlns(start))
+	depth := 1
+	for depth > 0 {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			tok = stripXmlns(t)
+		case xml.EndElement:
+			depth--
+		}
+		raw.tokens = append(raw.tokens, xml.CopyToken(tok))
+	}
+	return nil
+}
+
+// MarshalXML implements xml.Marshaler by writing the recorded tokens back out.
+func (raw rawXML) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	for _, tok := range raw.tokens {
+		err := e.EncodeToken(tok)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the recorded element.
+func (raw rawXML) Name() xml.Name {
+	if len(raw.tokens) == 0 {
+		return xml.Name{}
+	}
+	return raw.tokens[0].(xml.StartElement).Name
+}
+
+// Decode decodes the recorded element into v.
+func (raw rawXML) Decode(v any) error {
+	return xml.NewTokenDecoder(raw.TokenReader()).Decode(v)
+}
+
+// TokenReader replays the recorded element, so it can be read more than once.
+func (raw rawXML) TokenReader() xml.TokenReader {
+	i := 0
+	return xmlstream.ReaderFunc(func() (xml.Token, error) {
+		if i >= len(raw.tokens) {
+			return nil, io.EOF
+		}
+		i++
+		return raw.tokens[i-1], nil
+	})
+}
+
+// stripXmlns removes namespace declarations, since the encoder writes them again from the element name.
+func stripXmlns(start xml.StartElement) xml.StartElement {
+	start = start.Copy()
+	attrs := start.Attr[:0]
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	start.Attr = attrs
+	return start
+}
+
+// rawTokenReader maps a decoders RawToken method onto its Token method
+type rawTokenReader struct {
+	*xml.Decoder
+}
+
+func (r rawTokenReader) Token() (xml.Token, error) {
+	return r.RawToken()
+}
+
+// marshalTokens returns the XML encoding of v as a token stream that can be sent on the session.
+func marshalTokens(v any) (xml.TokenReader, error) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return rawTokenReader{xml.NewDecoder(bytes.NewReader(data))}, nil
+}
@@ -12,12 +12,34 @@ import (
 	"io"
 	"mellium.im/xmpp/stanza"
 	"mellium.im/xmpp/upload"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 )
 
+const (
+	defaultUploadRetries = 3
+	// uploadRetryDelay is the wait before the first retry, doubled after each until uploadMaxRetryDelay
+	uploadRetryDelay    = time.Second
+	uploadMaxRetryDelay = 30 * time.Second
+)
+
+var errUploadRetried = errors.New("upload is tried again")
+
+// UploadStatusError is returned when the HTTP server refuses an upload
+type UploadStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration // how long the server asked us to wait, 0 if it didn't say
+}
+
+func (e *UploadStatusError) Error() string {
+	return fmt.Sprintf("upload failed with status code: %d", e.StatusCode)
+}
+
 // UploadRequestDetails represents the XML structure for requesting an upload slot
 // from an XMPP server. It follows the XEP-0363 specification format.
 type UploadRequestDetails struct {
@@ -52,34 +74,43 @@ type UploadSlotResponse struct {
 	Slot UploadSlotResponsePayload `xml:"slot"`
 }
 
-// getUploadSlot requests an upload slot from the XMPP server's HTTP upload component.
+// getUploadSlot requests an upload slot from the XMPP server's HTTP upload components.
 // It returns the PUT URL with headers for uploading and the GET URL for retrieving the file.
-// Returns an error if the upload component isn't available or if the file size exceeds limits.
-// Times out after 30 seconds if a slot is not acquired.
-func (client *XmppClient) getUploadSlot(parentCtx context.Context, request upload.File) (*upload.Slot, error) {
-	if client.HttpUploadComponent == nil || client.HttpUploadComponent.Jid.String() == "" {
-		return nil, errors.New("no upload component found yet, try discovering services")
-	}
-
-	//we assume server is telling the truth
-	if request.Size > client.HttpUploadComponent.MaxFileSize {
-		return nil, fmt.Errorf(
-			"upload size too large, want %d, have %d",
-			request.Size, client.HttpUploadComponent.MaxFileSize,
-		)
+// Waits for service discovery to finish, then asks the upload services that accept a file of this size
+// one by one until one hands out a slot. Returns a *FileTooLargeError if the file is too large for all of them,
+// and the error of the most preferred service if none hands out a slot.
+// Each service gets 30 seconds to respond.
+func (client *XmppClient) getUploadSlot(ctx context.Context, request upload.File) (*upload.Slot, error) {
+	//discovery may still be running right after connecting
+	discoCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	err := client.AwaitDiscovery(discoCtx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("service discovery did not finish: %w", err)
 	}
 
-	slotCtx, cancel := context.WithTimeout(parentCtx, 30*time.Second)
-	defer cancel() // Important to prevent context leak
-
-	// use mellium function to get slot
-	slot, err := upload.GetSlot(slotCtx, request, client.HttpUploadComponent.Jid, client.Session)
-
-	//convert return values
+	//we assume servers are telling the truth about their limits
+	candidates, err := client.ServerCapabilities().uploadCandidates(int64(request.Size))
 	if err != nil {
 		return nil, err
 	}
-	return &slot, nil
+
+	var firstErr error
+	for _, component := range candidates {
+		slotCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		slot, err := client.requestSlot(slotCtx, component, request)
+		cancel()
+		if err == nil {
+			return slot, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
 }
 
 // UploadProgress represents the current status of an upload operation
@@ -131,89 +162,296 @@ func sendProgress(bytesSent int, totalBytes int, err error, getURL string, progr
 	}
 }
 
-// UploadFileFromBytes handles the complete process of uploading a file to the XMPP server.
-// It first requests an upload slot, then performs the HTTP PUT request to upload the file.
-// This method should be executed in a goroutine. Upload progress and status updates are sent through
-// the progressChan channel, which will be closed when the upload completes or fails.
-// Returns the GET URL where the file can be downloaded from, or an error if the upload fails.
-func (client *XmppClient) UploadFileFromBytes(
-	ctx context.Context,
-	filename string,
-	content []byte,
-	progressChan chan<- UploadProgress,
-) {
-	if progressChan != nil {
-		defer close(progressChan)
+// UploadOptions are the optional settings of an upload
+type UploadOptions struct {
+	HTTPClient  *http.Client         // client for the PUT request, for proxies, custom CAs and timeouts. Defaults to http.DefaultClient
+	Progress    func(UploadProgress) // called as the file is sent, from the goroutine running Upload
+	ContentType string               // MIME type of the file, detected from its name and contents if empty
+	Image       *ImageOptions        // how to clean up images before uploading them, XmppClient.UploadImages if nil
+	NoPreview   bool                 // don't make a thumbnail and blurhash of images
+	Retries     int                  // how often a failed PUT request is tried again, 3 if 0, never if negative
+}
+
+// Upload uploads size bytes read from r to the XMPP server as a file called name.
+// It first requests an upload slot, then streams r to it with an HTTP PUT request, so the file never
+// has to be held in memory. Returns the GET URL where the file can be downloaded from.
+func (client *XmppClient) Upload(ctx context.Context, name string, size int64, r io.Reader, opts UploadOptions) (string, error) {
+	res, err := client.UploadWithResult(ctx, name, size, r, opts)
+	if err != nil {
+		return "", err
 	}
+	return res.GetURL, nil
+}
 
-	if filename == "" || len(content) == 0 {
-		sendProgress(0, 0, errors.New("filename and content cannot be empty"), "", progressChan)
-		return
+// UploadWithResult works like Upload, but also returns what was learned about the file while
+// sending it: its content type, SHA-256 hash, and the dimensions or duration of media files.
+func (client *XmppClient) UploadWithResult(ctx context.Context, name string, size int64, r io.Reader, opts UploadOptions) (*UploadResult, error) {
+	if name == "" || size <= 0 {
+		return nil, errors.New("name and content cannot be empty")
+	}
+
+	//servers serve the file with the type we ask for, so never leave it out
+	file, err := client.prepareUpload(ctx, name, size, r, opts, 0)
+	if err != nil {
+		return nil, err
 	}
+	name, size, r = file.name, file.size, file.r
+	contentType := file.contentType
 
 	// put together data
 	request := upload.File{
-		Name: filepath.Base(filename),
-		Size: len(content),
+		Name: filepath.Base(name),
+		Size: int(size),
+		Type: contentType,
 	}
 
-	// request upload slot
-	slot, err := client.getUploadSlot(ctx, request)
+	//every attempt reads the file again, with a new probe so nothing is counted twice
+	rewind, ok := rewinder(r)
+	if !ok {
+		//streams that can't seek back are only sent once
+		opts.Retries = -1
+	}
+	var probe *mediaProbe
+	open := func() (io.Reader, error) {
+		if probe != nil {
+			probe.close(errUploadRetried)
+			err := rewind()
+			if err != nil {
+				return nil, err
+			}
+		}
+		probe = newMediaProbe(contentType, !opts.NoPreview)
+		return io.TeeReader(io.LimitReader(r, size), probe), nil
+	}
+	getURL, err := client.uploadStream(ctx, request, open, opts)
+	if probe != nil {
+		probe.close(err)
+	}
 	if err != nil {
-		sendProgress(0, request.Size, fmt.Errorf("failed to get upload slot: %w", err), "", progressChan)
-		return
+		return nil, err
+	}
+
+	res := &UploadResult{
+		GetURL:      getURL,
+		Name:        request.Name,
+		Size:        size,
+		ContentType: contentType,
+	}
+	probe.fill(res)
+	return res, nil
+}
+
+// uploadStream requests a slot for request and streams the body open returns to it, returning the GET URL.
+// The body must hold exactly request.Size bytes, which are sent with request.Type as content type.
+// Transient failures are tried again with backoff, calling open for the body from the start each time,
+// and a fresh slot is requested once if the old one has expired or was refused on its first use.
+func (client *XmppClient) uploadStream(ctx context.Context, request upload.File, open func() (io.Reader, error), opts UploadOptions) (string, error) {
+	retries := opts.Retries
+	if retries == 0 {
+		retries = defaultUploadRetries
 	}
 
+	var slot *upload.Slot
+	//a slot is replaced at most once per upload, so refusals that aren't about the slot can't resend the file forever
+	refreshed := false
+	putsOnSlot := 0
+	delay := uploadRetryDelay
+	for attempt := 0; ; attempt++ {
+		if slot == nil || (!refreshed && slotExpired(slot)) {
+			if slot != nil {
+				refreshed = true
+			}
+			var err error
+			slot, err = client.getUploadSlot(ctx, request)
+			if err != nil {
+				return "", fmt.Errorf("failed to get upload slot: %w", err)
+			}
+			putsOnSlot = 0
+		}
+
+		body, err := open()
+		if err != nil {
+			return "", fmt.Errorf("failed to read file: %w", err)
+		}
+		err = putFile(ctx, slot, request, body, opts)
+		if err == nil {
+			return slot.GetURL.String(), nil
+		}
+		putsOnSlot++
+
+		retry, refresh, wait := retryUpload(ctx, err)
+		if refresh {
+			//only a slot that expired or never worked is worth replacing
+			retry = !refreshed && (slotExpired(slot) || putsOnSlot == 1)
+		}
+		if !retry || attempt >= retries {
+			return "", err
+		}
+		if refresh {
+			slot = nil
+			refreshed = true
+		}
+		if wait <= 0 {
+			wait = delay
+			delay = min(delay*2, uploadMaxRetryDelay)
+		}
+		select {
+		case <-time.After(min(wait, uploadMaxRetryDelay)):
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+// putFile sends body to a slot with an HTTP PUT request
+func putFile(ctx context.Context, slot *upload.Slot, request upload.File, body io.Reader, opts UploadOptions) error {
 	//sanity check
 	if slot == nil || slot.PutURL == nil || slot.GetURL == nil {
-		sendProgress(0, request.Size, errors.New("upload slot response from the server is malformed"), "", progressChan)
-		return
+		return errors.New("upload slot response from the server is malformed")
 	}
 
-	// Create a custom reader that reports progress
+	size := int64(request.Size)
+	report := func(bytesSent int) {
+		if opts.Progress == nil {
+			return
+		}
+		opts.Progress(UploadProgress{
+			BytesSent:  bytesSent,
+			TotalBytes: int(size),
+			Percentage: float32(bytesSent) / float32(size) * 100,
+		})
+	}
+
+	// Create a progress tracking reader, never sending more than the slot was requested for
 	reader := &progressReader{
-		reader:       bytes.NewReader(content),
-		totalSize:    request.Size,
-		progressFunc: func(n int) { sendProgress(n, request.Size, nil, "", progressChan) },
+		reader:       io.LimitReader(body, size),
+		totalSize:    int(size),
+		progressFunc: report,
 	}
 
-	//create new request object
+	//create new request object with context for cancellation
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, slot.PutURL.String(), reader)
 	if err != nil {
-		sendProgress(0, request.Size, fmt.Errorf("failed to create upload request: %w", err), "", progressChan)
-		return
+		return fmt.Errorf("failed to create upload request: %w", err)
 	}
 
-	//Copy headers from slot.Header
+	// explicitly set the Content-Length header, the reader type hides it
+	req.ContentLength = size
+	if request.Type != "" {
+		req.Header.Set("Content-Type", request.Type)
+	}
+
+	//transfer headers
 	for k, v := range slot.Header {
 		req.Header[k] = v
 	}
 
 	//make request
-	resp, err := http.DefaultClient.Do(req)
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
-		sendProgress(reader.bytesRead, request.Size, fmt.Errorf("failed to upload file: %w", err), "", progressChan)
-		return
+		return fmt.Errorf("failed to upload file: %w", err)
 	}
 	defer resp.Body.Close()
 
 	//check if request succeeded
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return &FileTooLargeError{Size: size}
+	}
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		sendProgress(reader.bytesRead, request.Size,
-			fmt.Errorf("upload failed with status code: %d", resp.StatusCode), "", progressChan)
-		return
+		return &UploadStatusError{StatusCode: resp.StatusCode, RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	if reader.bytesRead < int(size) {
+		return fmt.Errorf("upload sent %d of %d bytes", reader.bytesRead, size)
 	}
+	return nil
+}
 
-	// Send final progress with GetURL
-	sendProgress(request.Size, request.Size, nil, slot.GetURL.String(), progressChan)
+// retryUpload decides whether a failed PUT request is tried again, whether that needs a fresh slot,
+// and how long the server asked us to wait, 0 if it didn't say
+func retryUpload(ctx context.Context, err error) (retry bool, refresh bool, wait time.Duration) {
+	if ctx.Err() != nil {
+		return false, false, 0
+	}
+	statusErr := &UploadStatusError{}
+	if !errors.As(err, &statusErr) {
+		//network errors are worth another try, short reads from the file are not
+		var netErr net.Error
+		var urlErr *url.Error
+		return errors.As(err, &netErr) || errors.As(err, &urlErr), false, 0
+	}
+	switch code := statusErr.StatusCode; {
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500:
+		return true, false, statusErr.RetryAfter
+	case code == http.StatusUnauthorized || code == http.StatusForbidden || code == http.StatusNotFound || code == http.StatusGone:
+		//slots are only valid for a while, so the service refuses old ones
+		return true, true, 0
+	}
+	return false, false, 0
+}
+
+// slotExpired reports whether the Expires header of a slot lies in the past
+func slotExpired(slot *upload.Slot) bool {
+	expires := slot.Header.Get("Expires")
+	if expires == "" {
+		return false
+	}
+	t, err := http.ParseTime(expires)
+	return err == nil && time.Now().After(t)
+}
+
+// retryAfter reads a Retry-After header given in seconds or as a date, 0 if there is none
+func retryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
 }
 
+// rewinder returns a function that moves r back to where it is now, so a failed upload can be sent again.
+// Returns false if r can't seek.
+func rewinder(r io.Reader) (func() error, bool) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return nil, false
+	}
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, false
+	}
+	return func() error {
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}, true
+}
 
-// UploadFile handles the complete process of uploading a file to the XMPP server.
-// It first requests an upload slot, then performs the HTTP PUT request to upload the file.
+// UploadFileFromBytes handles the complete process of uploading a file to the XMPP server using Upload.
 // This method should be executed in a goroutine. Upload progress and status updates are sent through
 // the progressChan channel, which will be closed when the upload completes or fails.
-// Returns the GET URL where the file can be downloaded from, or an error if the upload fails.
+// The final update holds the GET URL where the file can be downloaded from, or the error if the upload failed.
+func (client *XmppClient) UploadFileFromBytes(
+	ctx context.Context,
+	filename string,
+	content []byte,
+	progressChan chan<- UploadProgress,
+) {
+	if progressChan != nil {
+		defer close(progressChan)
+	}
+
+	client.uploadToChan(ctx, filename, int64(len(content)), bytes.NewReader(content), progressChan)
+}
+
+// UploadFile handles the complete process of uploading a file from disk to the XMPP server using Upload.
+// This method should be executed in a goroutine. To send many files, use an UploadManager instead. Upload progress and status updates are sent through
+// the progressChan channel, which will be closed when the upload completes or fails.
+// The final update holds the GET URL where the file can be downloaded from, or the error if the upload failed.
 func (client *XmppClient) UploadFile(
 	ctx context.Context,
 	path string,
@@ -243,62 +481,23 @@ func (client *XmppClient) UploadFile(
 		return
 	}
 
-	// put together data
-	request := upload.File{
-		Name: filepath.Base(path),
-		Size: int(fileInfo.Size()),
-	}
-
-	// request upload slot
-	slot, err := client.getUploadSlot(ctx, request)
-	if err != nil {
-		sendProgress(0, request.Size, fmt.Errorf("failed to get upload slot: %w", err), "", progressChan)
-		return
-	}
-
-	//sanity check
-	if slot == nil || slot.PutURL == nil || slot.GetURL == nil {
-		sendProgress(0, request.Size, errors.New("upload slot response from the server is malformed"), "", progressChan)
-		return
-	}
-
-	// Create a progress tracking reader
-	reader := &progressReader{
-		reader:       file,
-		totalSize:    int(fileInfo.Size()),
-		progressFunc: func(n int) { sendProgress(n, int(fileInfo.Size()), nil, "", progressChan) },
-	}
-
-	//create new request object with context for cancellation
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, slot.PutURL.String(), reader)
-	if err != nil {
-		sendProgress(0, request.Size, fmt.Errorf("failed to create upload request: %w", err), "", progressChan)
-		return
-	}
-
-	// explicitly set the Content-Length header
-	req.ContentLength = fileInfo.Size()
-
-	//transfer headers
-	for k, v := range slot.Header {
-		req.Header[k] = v
-	}
+	client.uploadToChan(ctx, path, fileInfo.Size(), file, progressChan)
+}
 
-	//make request
-	resp, err := http.DefaultClient.Do(req)
+// uploadToChan runs Upload, reporting progress and the outcome on progressChan
+func (client *XmppClient) uploadToChan(ctx context.Context, name string, size int64, r io.Reader, progressChan chan<- UploadProgress) {
+	bytesSent := 0
+	getURL, err := client.Upload(ctx, name, size, r, UploadOptions{
+		Progress: func(p UploadProgress) {
+			bytesSent = p.BytesSent
+			sendProgress(p.BytesSent, p.TotalBytes, nil, "", progressChan)
+		},
+	})
 	if err != nil {
-		sendProgress(reader.bytesRead, request.Size, fmt.Errorf("failed to upload file: %w", err), "", progressChan)
-		return
-	}
-	defer resp.Body.Close()
-
-	//check if request succeeded
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		sendProgress(reader.bytesRead, request.Size,
-			fmt.Errorf("upload failed with status code: %d", resp.StatusCode), "", progressChan)
+		sendProgress(bytesSent, int(size), err, "", progressChan)
 		return
 	}
 
 	// Send final progress with GetURL
-	sendProgress(request.Size, request.Size, nil, slot.GetURL.String(), progressChan)
+	sendProgress(int(size), int(size), nil, getURL, progressChan)
 }
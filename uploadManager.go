@@ -0,0 +1,633 @@
+package oasis_sdk
+
+// uploadManager.go queues uploads so many files can be sent without flooding the server. It limits how many
+// run at once, lets single uploads be paused or cancelled, and keeps the queue on disk so it picks up again
+// after a restart. Every upload ends with exactly one final event, which is delivered even across restarts.
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// uploadQueueFile is the name of the persistent upload queue inside LoginInfo.CacheDir
+	uploadQueueFile          = "uploads.json"
+	defaultUploadConcurrency = 3
+)
+
+var (
+	// ErrUploadManagerClosed is returned when adding or changing uploads of a manager that was closed
+	ErrUploadManagerClosed = errors.New("upload manager is closed")
+	// ErrUploadJobNotFound is returned for unknown job IDs, or jobs that can't be changed in their current state
+	ErrUploadJobNotFound = errors.New("no such upload job in a state that allows this")
+)
+
+// UploadJobState is where an upload job is in its life
+type UploadJobState string
+
+const (
+	UploadQueued    UploadJobState = "queued"
+	UploadRunning   UploadJobState = "uploading"
+	UploadPaused    UploadJobState = "paused"
+	UploadCompleted UploadJobState = "completed"
+	UploadFailed    UploadJobState = "failed"
+	UploadCanceled  UploadJobState = "canceled"
+)
+
+// Final reports whether a job in this state is done for good
+func (state UploadJobState) Final() bool {
+	return state == UploadCompleted || state == UploadFailed || state == UploadCanceled
+}
+
+// UploadJobOptions are the settings of a single queued upload
+type UploadJobOptions struct {
+	ContentType string // MIME type of the file, detected from its name and contents if empty
+	Encrypted   bool   // upload with UploadEncrypted instead of UploadWithResult
+	NoPreview   bool   // don't make a thumbnail and blurhash of images
+}
+
+// UploadJob is a snapshot of a queued upload
+type UploadJob struct {
+	ID         string
+	Path       string // file on disk, empty for uploads of bytes, which are not kept across restarts
+	Name       string
+	Size       int64 // size of the file as added
+	Options    UploadJobOptions
+	State      UploadJobState
+	BytesSent  int64
+	TotalBytes int64         // bytes the upload sends, which differs from Size for cleaned up images and encrypted files. 0 until it started
+	Result     *UploadResult // set once completed
+	Error      string        // set once failed
+}
+
+// UploadEvent tells about progress of a job, or, if Job.State is final, how it ended
+type UploadEvent struct {
+	Job UploadJob
+	Err error // why the job failed, only set with UploadFailed
+}
+
+// UploadEventHandler is called with the events of an upload manager, one at a time in order
+type UploadEventHandler func(manager *UploadManager, event UploadEvent)
+
+// UploadQueueProgress is the progress of all jobs of an upload manager together
+type UploadQueueProgress struct {
+	BytesSent  int64
+	TotalBytes int64 // size of all jobs that weren't cancelled
+	Percentage float32
+	Queued     int
+	Running    int
+	Paused     int
+	Completed  int
+	Failed     int
+	Canceled   int
+}
+
+// UploadManagerOptions are the settings of an upload manager
+type UploadManagerOptions struct {
+	MaxConcurrent int                // how many uploads run at once, 3 if 0
+	StateFile     string             // where the queue is kept, uploads.json in LoginInfo.CacheDir if empty. Not kept if neither is set
+	Handler       UploadEventHandler // receives progress and final events, set here so events from before a restart reach it
+	HTTPClient    *http.Client       // client for the PUT requests, defaults to http.DefaultClient
+	Retries       int                // how often a failed PUT request is tried again, as in UploadOptions
+}
+
+// UploadManager queues uploads and runs a limited number of them at once.
+// Progress events may be merged when the handler is slow, final events never are.
+type UploadManager struct {
+	client  *XmppClient
+	opts    UploadManagerOptions
+	lock    sync.Mutex
+	jobs    []*uploadJob
+	running int
+	closed  bool
+	wg      sync.WaitGroup
+	events  uploadEvents
+}
+
+// uploadJob is a job with the state only the manager sees
+type uploadJob struct {
+	UploadJob
+	delivered bool //the final event reached the handler
+	data      []byte
+	cancel    context.CancelFunc
+	stop      UploadJobState //state to take when the running upload stops, set by Pause and Cancel
+}
+
+// uploadEvents is the queue of events waiting for the handler. Progress events of a job replace each other.
+type uploadEvents struct {
+	lock     sync.Mutex
+	pending  []UploadEvent
+	progress map[string]int //index of the pending progress event of each job
+	wake     chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	handling atomic.Bool //the handler is running, so a Close from it must not wait for dispatch to end
+}
+
+// NewUploadManager creates an upload manager and resumes the jobs left in its state file.
+// Uploads that were running when the queue was saved start over with fresh slots, and final events that
+// never reached the handler are delivered again. The client should be connected, since queued jobs start
+// right away.
+func (client *XmppClient) NewUploadManager(opts UploadManagerOptions) (*UploadManager, error) {
+	if opts.MaxConcurrent <= 0 {
+		opts.MaxConcurrent = defaultUploadConcurrency
+	}
+	if opts.StateFile == "" && client.Login != nil && client.Login.CacheDir != "" {
+		opts.StateFile = filepath.Join(client.Login.CacheDir, uploadQueueFile)
+	}
+	manager := &UploadManager{
+		client: client,
+		opts:   opts,
+		events: uploadEvents{
+			progress: make(map[string]int),
+			wake:     make(chan struct{}, 1),
+			quit:     make(chan struct{}),
+			done:     make(chan struct{}),
+		},
+	}
+
+	err := manager.load()
+	if err != nil {
+		return nil, err
+	}
+	go manager.dispatch()
+
+	manager.lock.Lock()
+	for _, job := range manager.jobs {
+		if job.State.Final() && !job.delivered {
+			event := UploadEvent{Job: job.UploadJob}
+			if job.State == UploadFailed {
+				event.Err = errors.New(job.Error)
+			}
+			manager.emit(event)
+		}
+	}
+	manager.schedule()
+	manager.lock.Unlock()
+	return manager, nil
+}
+
+// Add queues the upload of a file on disk, returning the ID of its job
+func (manager *UploadManager) Add(path string, opts UploadJobOptions) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	return manager.add(&uploadJob{UploadJob: UploadJob{
+		Path:    path,
+		Name:    filepath.Base(path),
+		Size:    info.Size(),
+		Options: opts,
+	}})
+}
+
+// AddBytes queues the upload of content as a file called name, returning the ID of its job.
+// The bytes are not saved, so these jobs are forgotten on restart.
+func (manager *UploadManager) AddBytes(name string, content []byte, opts UploadJobOptions) (string, error) {
+	if name == "" || len(content) == 0 {
+		return "", errors.New("name and content cannot be empty")
+	}
+	return manager.add(&uploadJob{
+		UploadJob: UploadJob{
+			Name:    name,
+			Size:    int64(len(content)),
+			Options: opts,
+		},
+		data: content,
+	})
+}
+
+func (manager *UploadManager) add(job *uploadJob) (string, error) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.closed {
+		return "", ErrUploadManagerClosed
+	}
+	job.ID = randomID()
+	job.State = UploadQueued
+	manager.jobs = append(manager.jobs, job)
+	manager.save()
+	manager.schedule()
+	return job.ID, nil
+}
+
+// Pause stops a queued or running job until Resume is called. Running uploads are aborted and start over.
+func (manager *UploadManager) Pause(id string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.closed {
+		return ErrUploadManagerClosed
+	}
+	job := manager.find(id)
+	if job == nil || (job.State != UploadQueued && job.State != UploadRunning) {
+		return ErrUploadJobNotFound
+	}
+	if job.State == UploadRunning {
+		//the job finishes pausing once the upload returns
+		job.stop = UploadPaused
+		job.cancel()
+		return nil
+	}
+	job.State = UploadPaused
+	manager.save()
+	manager.emit(UploadEvent{Job: job.UploadJob})
+	return nil
+}
+
+// Resume puts a paused job back in the queue
+func (manager *UploadManager) Resume(id string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.closed {
+		return ErrUploadManagerClosed
+	}
+	job := manager.find(id)
+	if job == nil || job.State != UploadPaused {
+		return ErrUploadJobNotFound
+	}
+	job.State = UploadQueued
+	job.BytesSent = 0
+	manager.save()
+	manager.emit(UploadEvent{Job: job.UploadJob})
+	manager.schedule()
+	return nil
+}
+
+// Cancel ends a job that hasn't finished yet, aborting it if it is running
+func (manager *UploadManager) Cancel(id string) error {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	if manager.closed {
+		return ErrUploadManagerClosed
+	}
+	job := manager.find(id)
+	if job == nil || job.State.Final() {
+		return ErrUploadJobNotFound
+	}
+	if job.State == UploadRunning {
+		job.stop = UploadCanceled
+		job.cancel()
+		return nil
+	}
+	job.State = UploadCanceled
+	manager.save()
+	manager.emit(UploadEvent{Job: job.UploadJob})
+	return nil
+}
+
+// Job returns a snapshot of the job with this ID
+func (manager *UploadManager) Job(id string) (UploadJob, bool) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	job := manager.find(id)
+	if job == nil {
+		return UploadJob{}, false
+	}
+	return job.UploadJob, true
+}
+
+// Jobs returns snapshots of all jobs in the order they were added
+func (manager *UploadManager) Jobs() []UploadJob {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	res := make([]UploadJob, 0, len(manager.jobs))
+	for _, job := range manager.jobs {
+		res = append(res, job.UploadJob)
+	}
+	return res
+}
+
+// Clear forgets finished jobs whose final event was delivered
+func (manager *UploadManager) Clear() {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	manager.jobs = slices.DeleteFunc(manager.jobs, func(job *uploadJob) bool {
+		return job.State.Final() && job.delivered
+	})
+}
+
+// Progress adds up the progress of all jobs
+func (manager *UploadManager) Progress() UploadQueueProgress {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	res := UploadQueueProgress{}
+	for _, job := range manager.jobs {
+		switch job.State {
+		case UploadQueued:
+			res.Queued++
+		case UploadRunning:
+			res.Running++
+		case UploadPaused:
+			res.Paused++
+		case UploadCompleted:
+			res.Completed++
+		case UploadFailed:
+			res.Failed++
+		case UploadCanceled:
+			res.Canceled++
+			continue
+		}
+		res.TotalBytes += cmp.Or(job.TotalBytes, job.Size)
+		res.BytesSent += job.BytesSent
+	}
+	if res.TotalBytes > 0 {
+		res.Percentage = float32(res.BytesSent) / float32(res.TotalBytes) * 100
+	}
+	return res
+}
+
+// Close stops the manager. Running uploads are aborted and kept in the queue, so they start over
+// with the next manager. Returns once every pending event was handed to the handler. Called while the handler
+// runs, such as from the handler itself, it can't wait for that, and the remaining events are delivered once
+// the handler returns.
+func (manager *UploadManager) Close() {
+	manager.lock.Lock()
+	if manager.closed {
+		manager.lock.Unlock()
+		return
+	}
+	manager.closed = true
+	for _, job := range manager.jobs {
+		if job.State == UploadRunning {
+			job.cancel()
+		}
+	}
+	manager.lock.Unlock()
+
+	manager.wg.Wait()
+	close(manager.events.quit)
+	if manager.events.handling.Load() {
+		//the handler runs on the dispatch goroutine, waiting for it to end would never return
+		return
+	}
+	<-manager.events.done
+}
+
+// find returns the job with this ID, nil if there is none. Must be called with the lock held.
+func (manager *UploadManager) find(id string) *uploadJob {
+	for _, job := range manager.jobs {
+		if job.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// schedule starts queued jobs in order while there is room. Must be called with the lock held.
+func (manager *UploadManager) schedule() {
+	for _, job := range manager.jobs {
+		if manager.closed || manager.running >= manager.opts.MaxConcurrent {
+			return
+		}
+		if job.State != UploadQueued {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		job.State = UploadRunning
+		job.BytesSent = 0
+		job.cancel = cancel
+		job.stop = ""
+		manager.running++
+		manager.wg.Add(1)
+		manager.emit(UploadEvent{Job: job.UploadJob})
+		go manager.run(ctx, job)
+	}
+}
+
+// run uploads a job and records how it ended
+func (manager *UploadManager) run(ctx context.Context, job *uploadJob) {
+	defer manager.wg.Done()
+	res, err := manager.upload(ctx, job)
+
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	job.cancel()
+	job.cancel = nil
+	manager.running--
+
+	event := UploadEvent{}
+	switch {
+	case err == nil:
+		job.State = UploadCompleted
+		job.Result = res
+		job.BytesSent = cmp.Or(job.TotalBytes, job.Size)
+	case job.stop != "":
+		job.State = job.stop
+		job.BytesSent = 0
+	case manager.closed:
+		//aborted by Close, so it runs again with the next manager
+		job.State = UploadQueued
+		job.BytesSent = 0
+	default:
+		job.State = UploadFailed
+		job.Error = err.Error()
+		event.Err = err
+	}
+	manager.save()
+	if !manager.closed || job.State.Final() {
+		event.Job = job.UploadJob
+		manager.emit(event)
+	}
+	manager.schedule()
+}
+
+// upload sends the file of a job, reporting its progress
+func (manager *UploadManager) upload(ctx context.Context, job *uploadJob) (*UploadResult, error) {
+	manager.lock.Lock()
+	snapshot := job.UploadJob
+	data := job.data
+	manager.lock.Unlock()
+
+	opts := UploadOptions{
+		HTTPClient:  manager.opts.HTTPClient,
+		ContentType: snapshot.Options.ContentType,
+		NoPreview:   snapshot.Options.NoPreview,
+		Retries:     manager.opts.Retries,
+		Progress: func(p UploadProgress) {
+			manager.lock.Lock()
+			defer manager.lock.Unlock()
+			if job.State != UploadRunning || job.stop != "" {
+				return
+			}
+			//image cleanup and encryption change the size that is sent, Size stays what the file holds
+			job.TotalBytes = int64(p.TotalBytes)
+			job.BytesSent = int64(p.BytesSent)
+			manager.emit(UploadEvent{Job: job.UploadJob})
+		},
+	}
+
+	var r io.Reader
+	size := snapshot.Size
+	if data != nil {
+		r, size = bytes.NewReader(data), int64(len(data))
+	} else {
+		file, err := os.Open(snapshot.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file info: %w", err)
+		}
+		r, size = file, info.Size()
+	}
+
+	if snapshot.Options.Encrypted {
+		return manager.client.UploadEncrypted(ctx, snapshot.Name, size, r, opts)
+	}
+	return manager.client.UploadWithResult(ctx, snapshot.Name, size, r, opts)
+}
+
+// emit queues an event for the handler. Must be called with the manager lock held, so events keep their order.
+func (manager *UploadManager) emit(event UploadEvent) {
+	events := &manager.events
+	events.lock.Lock()
+	if i, ok := events.progress[event.Job.ID]; ok && !event.Job.State.Final() && event.Job.State == events.pending[i].Job.State {
+		//the handler only needs the latest progress
+		events.pending[i] = event
+	} else {
+		if !event.Job.State.Final() {
+			events.progress[event.Job.ID] = len(events.pending)
+		} else {
+			delete(events.progress, event.Job.ID)
+		}
+		events.pending = append(events.pending, event)
+	}
+	events.lock.Unlock()
+
+	select {
+	case events.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands queued events to the handler one at a time until the manager is closed and no events are left
+func (manager *UploadManager) dispatch() {
+	events := &manager.events
+	defer close(events.done)
+	for {
+		events.lock.Lock()
+		pending := events.pending
+		events.pending = nil
+		clear(events.progress)
+		events.lock.Unlock()
+
+		if len(pending) == 0 {
+			select {
+			case <-events.wake:
+				continue
+			case <-events.quit:
+				//Close waited for the uploads, so nothing is emitted anymore, but look once more
+				events.lock.Lock()
+				empty := len(events.pending) == 0
+				events.lock.Unlock()
+				if empty {
+					return
+				}
+				continue
+			}
+		}
+
+		for _, event := range pending {
+			if manager.opts.Handler != nil {
+				events.handling.Store(true)
+				manager.opts.Handler(manager, event)
+				events.handling.Store(false)
+			}
+			if event.Job.State.Final() {
+				manager.delivered(event.Job.ID)
+			}
+		}
+	}
+}
+
+// delivered marks the final event of a job as handled, so it is not sent again after a restart
+func (manager *UploadManager) delivered(id string) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	job := manager.find(id)
+	if job == nil {
+		return
+	}
+	job.delivered = true
+	manager.save()
+}
+
+// load reads the jobs left in the state file. Jobs that were running are queued again.
+func (manager *UploadManager) load() error {
+	if manager.opts.StateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(manager.opts.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload queue: %w", err)
+	}
+
+	var jobs []*uploadJob
+	err = json.Unmarshal(data, &jobs)
+	if err != nil {
+		return fmt.Errorf("failed to parse upload queue: %w", err)
+	}
+	for _, job := range jobs {
+		if job.State == UploadRunning {
+			job.State = UploadQueued
+		}
+		if !job.State.Final() {
+			job.BytesSent = 0
+		}
+	}
+	manager.jobs = jobs
+	return nil
+}
+
+// save writes the jobs that must survive a restart to the state file: the unfinished ones backed by
+// a file, and the finished ones whose final event wasn't delivered yet. Must be called with the lock held.
+func (manager *UploadManager) save() {
+	if manager.opts.StateFile == "" {
+		return
+	}
+	jobs := make([]*uploadJob, 0, len(manager.jobs))
+	for _, job := range manager.jobs {
+		if job.Path != "" && !job.delivered {
+			jobs = append(jobs, job)
+		}
+	}
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		fmt.Printf("Could not encode upload queue: %v\n", err)
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(manager.opts.StateFile), 0o700)
+	if err != nil {
+		fmt.Printf("Could not create upload queue dir: %v\n", err)
+		return
+	}
+	//write next to it and rename, so a crash never leaves half a queue
+	tmp := manager.opts.StateFile + ".tmp"
+	err = os.WriteFile(tmp, data, 0o600)
+	if err == nil {
+		err = os.Rename(tmp, manager.opts.StateFile)
+	}
+	if err != nil {
+		fmt.Printf("Could not write upload queue: %v\n", err)
+	}
+}
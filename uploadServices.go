@@ -0,0 +1,293 @@
+package oasis_sdk
+
+// uploadServices.go requests upload slots from every kind of upload service a server may run: the current
+// https://xmpp.org/extensions/xep-0363.html and the namespaces of its older versions, which some servers still
+// only offer. Slot errors are turned into typed errors.
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/upload"
+)
+
+const (
+	// nsHttpUploadLegacy is the namespace of versions 0.2 to 0.4 of XEP-0363
+	nsHttpUploadLegacy = "urn:xmpp:http:upload"
+	// nsHttpUploadSiacs is the namespace Conversations used before XEP-0363 was accepted
+	nsHttpUploadSiacs = "eu:siacs:conversations:http:upload"
+)
+
+// uploadNamespaces are the upload namespaces we speak, most preferred first
+var uploadNamespaces = []string{nsHttpUpload, nsHttpUploadLegacy, nsHttpUploadSiacs}
+
+// FileTooLargeError is returned when no upload service accepts a file of this size
+type FileTooLargeError struct {
+	Size        int64
+	MaxFileSize int64 // largest file the service accepts, 0 if it didn't say
+}
+
+func (e *FileTooLargeError) Error() string {
+	if e.MaxFileSize == 0 {
+		return fmt.Sprintf("file of %d bytes is too large to upload", e.Size)
+	}
+	return fmt.Sprintf("file of %d bytes is too large to upload, the limit is %d", e.Size, e.MaxFileSize)
+}
+
+// QuotaExceededError is returned when the upload service refuses a file because we uploaded too much
+type QuotaExceededError struct {
+	RetryAt time.Time // when uploading is allowed again, zero if the service didn't say
+	Err     stanza.Error
+}
+
+func (e *QuotaExceededError) Error() string {
+	if e.RetryAt.IsZero() {
+		return "upload quota exceeded"
+	}
+	return fmt.Sprintf("upload quota exceeded, retry at %s", e.RetryAt.Format(time.RFC3339))
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return e.Err
+}
+
+// legacySlotRequest requests a slot in the namespaces of older versions, which use elements instead of attributes
+type legacySlotRequest struct {
+	XMLName     xml.Name
+	Filename    string `xml:"filename"`
+	Size        int64  `xml:"size"`
+	ContentType string `xml:"content-type,omitempty"`
+}
+
+// uploadSlotReply is the answer to a slot request in any of the upload namespaces
+type uploadSlotReply struct {
+	Type string `xml:"type,attr"`
+	Slot *struct {
+		//current versions put the URLs in attributes, older ones in the text
+		Put struct {
+			URL     string   `xml:"url,attr"`
+			Text    string   `xml:",chardata"`
+			Headers []Header `xml:"header"`
+		} `xml:"put"`
+		Get struct {
+			URL  string `xml:"url,attr"`
+			Text string `xml:",chardata"`
+		} `xml:"get"`
+	} `xml:"slot"`
+	Error *rawXML `xml:"error"`
+}
+
+// uploadErrorDetails are the application specific conditions of slot errors, in any upload namespace
+type uploadErrorDetails struct {
+	FileTooLarge *struct {
+		MaxFileSize int64 `xml:"max-file-size"`
+		MaxSize     int64 `xml:"max-size"` //older versions
+	} `xml:"file-too-large"`
+	Retry *struct {
+		Stamp string `xml:"stamp,attr"`
+	} `xml:"retry"`
+}
+
+// uploadNamespaceOf returns the most preferred upload namespace an upload service supports, empty for none
+func uploadNamespaceOf(info disco.Info) string {
+	for _, ns := range uploadNamespaces {
+		if hasFeature(info, ns) {
+			return ns
+		}
+	}
+	return ""
+}
+
+// uploadCandidates orders the upload services that accept a file of size, most preferred first.
+// Services with the current namespace come first, then the ones with the highest limit.
+// If none accepts the file, the error says the highest limit.
+func (caps ServerCapabilities) uploadCandidates(size int64) ([]HttpUploadComponent, error) {
+	components := caps.UploadComponents
+	if len(components) == 0 {
+		return nil, errors.New("no upload component found on the server")
+	}
+
+	var candidates []HttpUploadComponent
+	largest := int64(0)
+	for _, component := range components {
+		limit := int64(component.MaxFileSize)
+		largest = max(largest, limit)
+		//a service without a limit takes anything, or at least didn't tell us otherwise
+		if limit == 0 || size <= limit {
+			candidates = append(candidates, component)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, &FileTooLargeError{Size: size, MaxFileSize: largest}
+	}
+
+	rank := func(component HttpUploadComponent) int {
+		return slices.Index(uploadNamespaces, component.Namespace)
+	}
+	slices.SortStableFunc(candidates, func(a, b HttpUploadComponent) int {
+		if rank(a) != rank(b) {
+			return rank(a) - rank(b)
+		}
+		limitA, limitB := int64(a.MaxFileSize), int64(b.MaxFileSize)
+		switch {
+		case limitA == limitB:
+			return 0
+		case limitA == 0:
+			return -1
+		case limitB == 0:
+			return 1
+		case limitA > limitB:
+			return -1
+		default:
+			return 1
+		}
+	})
+	return candidates, nil
+}
+
+// maxUploadSize returns the largest file any upload service accepts, 0 if there is no limit or it is unknown
+func (client *XmppClient) maxUploadSize() int64 {
+	largest := int64(0)
+	for _, component := range client.ServerCapabilities().UploadComponents {
+		if component.MaxFileSize == 0 {
+			return 0
+		}
+		largest = max(largest, int64(component.MaxFileSize))
+	}
+	return largest
+}
+
+// requestSlot requests an upload slot from a single upload service, in the namespace it speaks
+func (client *XmppClient) requestSlot(ctx context.Context, component HttpUploadComponent, request upload.File) (*upload.Slot, error) {
+	var payload any
+	switch component.Namespace {
+	case nsHttpUploadLegacy, nsHttpUploadSiacs:
+		payload = legacySlotRequest{
+			XMLName:     xml.Name{Space: component.Namespace, Local: "request"},
+			Filename:    request.Name,
+			Size:        int64(request.Size),
+			ContentType: request.Type,
+		}
+	default:
+		contentType := &request.Type
+		if request.Type == "" {
+			contentType = nil
+		}
+		payload = UploadRequestDetails{
+			Filename:    request.Name,
+			Size:        int64(request.Size),
+			ContentType: contentType,
+		}
+	}
+	tokens, err := marshalTokens(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	//send it ourselves, the error payload says why the slot was refused
+	resp, err := client.Session.SendIQElement(ctx, tokens, stanza.IQ{Type: stanza.GetIQ, To: component.Jid})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Close()
+	reply := uploadSlotReply{}
+	err = xml.NewTokenDecoder(resp).Decode(&reply)
+	if err != nil {
+		return nil, fmt.Errorf("malformed slot response: %w", err)
+	}
+
+	if reply.Type == string(stanza.ErrorIQ) || reply.Error != nil {
+		return nil, slotError(reply.Error, int64(request.Size))
+	}
+	if reply.Slot == nil {
+		return nil, errors.New("upload slot response from the server is malformed")
+	}
+
+	putURL, err := url.Parse(firstNonEmpty(reply.Slot.Put.URL, strings.TrimSpace(reply.Slot.Put.Text)))
+	if err != nil || putURL.String() == "" {
+		return nil, errors.New("upload slot response from the server has no valid PUT URL")
+	}
+	getURL, err := url.Parse(firstNonEmpty(reply.Slot.Get.URL, strings.TrimSpace(reply.Slot.Get.Text)))
+	if err != nil || getURL.String() == "" {
+		return nil, errors.New("upload slot response from the server has no valid GET URL")
+	}
+
+	slot := &upload.Slot{
+		PutURL: putURL,
+		GetURL: getURL,
+		Header: http.Header{},
+	}
+	for _, header := range reply.Slot.Put.Headers {
+		//only these may be set by the service as per https://xmpp.org/extensions/xep-0363.html#request
+		name := http.CanonicalHeaderKey(header.Name)
+		if name == "Authorization" || name == "Cookie" || name == "Expires" {
+			slot.Header.Add(name, strings.NewReplacer("\r", "", "\n", "").Replace(header.Value))
+		}
+	}
+	return slot, nil
+}
+
+// slotError turns the error of a slot request into a typed error where there is one
+func slotError(raw *rawXML, size int64) error {
+	if raw == nil {
+		return errors.New("upload slot request failed")
+	}
+	stanzaErr := stanza.Error{}
+	err := raw.Decode(&stanzaErr)
+	if err != nil {
+		return fmt.Errorf("malformed slot error: %w", err)
+	}
+	details := uploadErrorDetails{}
+	_ = raw.Decode(&details)
+
+	switch {
+	case details.FileTooLarge != nil:
+		return &FileTooLargeError{
+			Size:        size,
+			MaxFileSize: max(details.FileTooLarge.MaxFileSize, details.FileTooLarge.MaxSize),
+		}
+	case details.Retry != nil || stanzaErr.Condition == stanza.ResourceConstraint:
+		quota := &QuotaExceededError{Err: stanzaErr}
+		if details.Retry != nil {
+			quota.RetryAt, _ = time.Parse(time.RFC3339, details.Retry.Stamp)
+		}
+		return quota
+	}
+	return stanzaErr
+}
+
+// firstNonEmpty returns the first of values that isn't empty
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parseMaxFileSize reads the size limit from the disco#info form of an upload service, 0 if there is none
+func parseMaxFileSize(info disco.Info) int {
+	for _, x := range info.Form {
+		v, ok := x.GetString("max-file-size")
+		if !ok {
+			continue
+		}
+		maxFileSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return int(maxFileSize)
+	}
+	return 0
+}
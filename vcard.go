@@ -0,0 +1,345 @@
+package oasis_sdk
+
+// vcard.go implements profiles using vCard4 over PEP as per https://xmpp.org/extensions/xep-0292.html,
+// with a fallback to vcard-temp as per https://xmpp.org/extensions/xep-0054.html,
+// and nicknames as per https://xmpp.org/extensions/xep-0172.html
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/pubsub"
+	"mellium.im/xmpp/stanza"
+)
+
+const (
+	nsVCardTemp = "vcard-temp"
+	nsVCard4    = "urn:ietf:params:xml:ns:vcard-4.0"
+	nsVCard4PEP = "urn:xmpp:vcard4"
+	nsNick      = "http://jabber.org/protocol/nick"
+)
+
+// Profile is the typed subset of a vCard that the sdk reads and writes.
+// Other vCard fields are preserved when publishing.
+type Profile struct {
+	FullName string
+	Nickname string
+	Emails   []string
+	URLs     []string
+	Note     string
+	Org      string
+	Timezone string
+}
+
+// Nick is the payload of the nickname node from https://xmpp.org/extensions/xep-0172.html
+type Nick struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/nick nick"`
+	Value   string   `xml:",chardata"`
+}
+
+// ------ vcard-temp -------
+
+// vCardTempPhoto is the PHOTO element of a vcard-temp
+type vCardTempPhoto struct {
+	Type   string `xml:"TYPE"`
+	BinVal string `xml:"BINVAL"`
+}
+
+type vCardTempEmail struct {
+	Internet *struct{} `xml:"INTERNET"`
+	UserID   string    `xml:"USERID"`
+}
+
+type vCardTempOrg struct {
+	Name string `xml:"ORGNAME"`
+}
+
+// vCardTemp is a vcard-temp where the fields we use are decoded, everything else is kept as is
+type vCardTemp struct {
+	XMLName  xml.Name         `xml:"vcard-temp vCard"`
+	FN       string           `xml:"FN,omitempty"`
+	Nickname string           `xml:"NICKNAME,omitempty"`
+	Email    []vCardTempEmail `xml:"EMAIL"`
+	URL      []string         `xml:"URL"`
+	Desc     string           `xml:"DESC,omitempty"`
+	Org      *vCardTempOrg    `xml:"ORG"`
+	TZ       string           `xml:"TZ,omitempty"`
+	Photo    *vCardTempPhoto  `xml:"PHOTO"`
+	Other    []rawXML         `xml:",any"`
+}
+
+// ------ vCard4 -------
+
+type vCard4Text struct {
+	Text string `xml:"text"`
+}
+
+type vCard4URI struct {
+	URI string `xml:"uri"`
+}
+
+// vCard4 is a vCard4 where the fields we use are decoded, everything else is kept as is
+type vCard4 struct {
+	XMLName  xml.Name     `xml:"urn:ietf:params:xml:ns:vcard-4.0 vcard"`
+	FN       *vCard4Text  `xml:"fn"`
+	Nickname []vCard4Text `xml:"nickname"`
+	Email    []vCard4Text `xml:"email"`
+	URL      []vCard4URI  `xml:"url"`
+	Note     *vCard4Text  `xml:"note"`
+	Org      *vCard4Text  `xml:"org"`
+	TZ       *vCard4Text  `xml:"tz"`
+	Other    []rawXML     `xml:",any"`
+}
+
+// SetNicknameHandler sets the handler function called when a contact publishes a new nickname.
+func (client *XmppClient) SetNicknameHandler(handler NicknameHandler) {
+	client.handlers.Lock.Lock()
+	client.handlers.NicknameHandler = handler
+	client.handlers.Lock.Unlock()
+}
+
+// FetchProfile fetches the vCard4 of j from PEP, falling back to vcard-temp.
+// Pass an empty JID to fetch our own profile.
+func (client *XmppClient) FetchProfile(ctx context.Context, j jid.JID) (*Profile, error) {
+	if j.Equal(jid.JID{}) {
+		j = client.JID.Bare()
+	}
+
+	card := vCard4{}
+	pepErr := errOccupantPEP
+	if !client.isOccupant(j) {
+		pepErr = client.fetchPEPItem(ctx, j, nsVCard4PEP, "", &card)
+	}
+	if pepErr == nil {
+		return card.profile(), nil
+	}
+
+	vcard, err := client.fetchVCardTemp(ctx, j)
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch profile of %s: %w", j.String(), errors.Join(pepErr, err))
+	}
+	return vcard.profile(), nil
+}
+
+// PublishProfile publishes our profile as a vCard4 to PEP, falling back to vcard-temp if the server
+// doesn't support it. Fields not covered by Profile are kept from the currently published vCard, so nothing is
+// published if that can't be fetched.
+func (client *XmppClient) PublishProfile(ctx context.Context, profile Profile) error {
+	//start from what's published so other clients' data isn't lost
+	card := vCard4{}
+	pepErr := client.fetchPEPItem(ctx, client.JID.Bare(), nsVCard4PEP, "", &card)
+	switch {
+	case pepErr == nil || isNotFound(pepErr):
+		card.apply(profile)
+		item, err := marshalTokens(card)
+		if err != nil {
+			return err
+		}
+		_, pepErr = pubsub.Publish(ctx, client.Session, nsVCard4PEP, "current", item)
+		if pepErr == nil {
+			return nil
+		}
+	case !pepUnsupported(pepErr):
+		//publishing now would overwrite the profile with one that lost everything Profile doesn't cover
+		return fmt.Errorf("unable to fetch current profile: %w", pepErr)
+	}
+
+	vcard, err := client.fetchVCardTemp(ctx, jid.JID{})
+	switch {
+	case isNotFound(err):
+		//an account without a vcard answers item-not-found
+		vcard = &vCardTemp{}
+	case err != nil:
+		return fmt.Errorf("unable to fetch current profile: %w", errors.Join(pepErr, err))
+	}
+	vcard.apply(profile)
+	err = client.publishVCardTemp(ctx, vcard)
+	if err != nil {
+		return fmt.Errorf("unable to publish profile: %w", errors.Join(pepErr, err))
+	}
+	return nil
+}
+
+// isNotFound reports whether fetching an item failed only because there is none
+func isNotFound(err error) bool {
+	return errors.Is(err, errNoPEPItem) || errors.Is(err, stanza.Error{Condition: stanza.ItemNotFound})
+}
+
+// pepUnsupported reports whether a PEP request failed because the server doesn't offer PEP
+func pepUnsupported(err error) bool {
+	return errors.Is(err, stanza.Error{Condition: stanza.FeatureNotImplemented}) ||
+		errors.Is(err, stanza.Error{Condition: stanza.ServiceUnavailable})
+}
+
+// PublishNickname publishes our nickname to PEP as per https://xmpp.org/extensions/xep-0172.html#manage
+func (client *XmppClient) PublishNickname(ctx context.Context, nick string) error {
+	item, err := marshalTokens(Nick{Value: nick})
+	if err != nil {
+		return err
+	}
+	_, err = pubsub.Publish(ctx, client.Session, nsNick, "current", item)
+	if err != nil {
+		return fmt.Errorf("unable to publish nickname: %w", err)
+	}
+	return nil
+}
+
+// FetchNickname fetches the nickname j published to PEP.
+func (client *XmppClient) FetchNickname(ctx context.Context, j jid.JID) (string, error) {
+	nick := Nick{}
+	err := client.fetchPEPItem(ctx, j, nsNick, "", &nick)
+	return nick.Value, err
+}
+
+// publishDisplayName publishes LoginInfo.DisplayName as our nickname, if one is set.
+func (client *XmppClient) publishDisplayName() {
+	if client.Login.DisplayName == "" {
+		return
+	}
+	err := client.PublishNickname(client.Ctx, client.Login.DisplayName)
+	if err != nil {
+		fmt.Printf("Could not publish display name: %v\n", err)
+	}
+}
+
+// internalHandleNick handles a nickname notification from PEP
+func (client *XmppClient) internalHandleNick(from jid.JID, items []pepItem) {
+	if len(items) == 0 {
+		return
+	}
+	nick := Nick{}
+	err := items[0].Payload.Decode(&nick)
+	if err != nil {
+		return
+	}
+
+	//get handler with lock
+	client.handlers.Lock.Lock()
+	handler := client.handlers.NicknameHandler
+	client.handlers.Lock.Unlock()
+
+	if handler != nil {
+		handler(client, from, nick.Value)
+	}
+}
+
+// fetchVCardTemp fetches the vcard-temp of j, or our own when j is empty.
+// The vcard of a room occupant is asked from its full JID, anyone else's from the bare one.
+func (client *XmppClient) fetchVCardTemp(ctx context.Context, j jid.JID) (*vCardTemp, error) {
+	to := j.Bare()
+	if client.isOccupant(j) {
+		to = j
+	}
+	vcard := &vCardTemp{}
+	err := client.Session.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		nil,
+		xml.StartElement{Name: xml.Name{Space: nsVCardTemp, Local: "vCard"}},
+	), stanza.IQ{
+		Type: stanza.GetIQ,
+		To:   to,
+	}, vcard)
+	return vcard, err
+}
+
+// publishVCardTemp replaces our vcard-temp with vcard
+func (client *XmppClient) publishVCardTemp(ctx context.Context, vcard *vCardTemp) error {
+	payload, err := marshalTokens(vcard)
+	if err != nil {
+		return err
+	}
+	return client.Session.UnmarshalIQElement(ctx, payload, stanza.IQ{Type: stanza.SetIQ}, nil)
+}
+
+// profile converts the vcard-temp into a Profile
+func (vcard *vCardTemp) profile() *Profile {
+	p := &Profile{
+		FullName: vcard.FN,
+		Nickname: vcard.Nickname,
+		URLs:     vcard.URL,
+		Note:     vcard.Desc,
+		Timezone: vcard.TZ,
+	}
+	for _, email := range vcard.Email {
+		p.Emails = append(p.Emails, email.UserID)
+	}
+	if vcard.Org != nil {
+		p.Org = vcard.Org.Name
+	}
+	return p
+}
+
+// apply overwrites the fields of the vcard-temp covered by Profile
+func (vcard *vCardTemp) apply(p Profile) {
+	vcard.FN = p.FullName
+	vcard.Nickname = p.Nickname
+	vcard.URL = p.URLs
+	vcard.Desc = p.Note
+	vcard.TZ = p.Timezone
+	vcard.Email = nil
+	for _, email := range p.Emails {
+		vcard.Email = append(vcard.Email, vCardTempEmail{Internet: &struct{}{}, UserID: email})
+	}
+	vcard.Org = nil
+	if p.Org != "" {
+		vcard.Org = &vCardTempOrg{Name: p.Org}
+	}
+}
+
+// profile converts the vCard4 into a Profile
+func (card *vCard4) profile() *Profile {
+	p := &Profile{}
+	if card.FN != nil {
+		p.FullName = card.FN.Text
+	}
+	if len(card.Nickname) > 0 {
+		p.Nickname = card.Nickname[0].Text
+	}
+	for _, email := range card.Email {
+		p.Emails = append(p.Emails, email.Text)
+	}
+	for _, url := range card.URL {
+		p.URLs = append(p.URLs, url.URI)
+	}
+	if card.Note != nil {
+		p.Note = card.Note.Text
+	}
+	if card.Org != nil {
+		p.Org = card.Org.Text
+	}
+	if card.TZ != nil {
+		p.Timezone = card.TZ.Text
+	}
+	return p
+}
+
+// apply overwrites the fields of the vCard4 covered by Profile
+func (card *vCard4) apply(p Profile) {
+	card.FN = optionalVCard4Text(p.FullName)
+	card.Nickname = nil
+	if p.Nickname != "" {
+		card.Nickname = []vCard4Text{{Text: p.Nickname}}
+	}
+	card.Email = nil
+	for _, email := range p.Emails {
+		card.Email = append(card.Email, vCard4Text{Text: email})
+	}
+	card.URL = nil
+	for _, url := range p.URLs {
+		card.URL = append(card.URL, vCard4URI{URI: url})
+	}
+	card.Note = optionalVCard4Text(p.Note)
+	card.Org = optionalVCard4Text(p.Org)
+	card.TZ = optionalVCard4Text(p.Timezone)
+}
+
+// optionalVCard4Text leaves out empty vCard4 properties
+func optionalVCard4Text(s string) *vCard4Text {
+	if s == "" {
+		return nil
+	}
+	return &vCard4Text{Text: s}
+}